@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	tableOutput = "table"
+	jsonOutput  = "json"
+	yamlOutput  = "yaml"
+)
+
+// the config verbs that manage existing aliases, with how many alias names each takes
+var aliasVerbArgs = map[string]int{"list": 0, "show": 1, "delete": 1, "rename": 2, "set-default": 1}
+
+// aliasSummary is how an alias is shown by config list and config show. The refresh token is a secret,
+// so only whether there is one is shown.
+type aliasSummary struct {
+	Alias                    string `json:"alias" yaml:"alias"`
+	Default                  bool   `json:"default" yaml:"default"`
+	ServerURL                string `json:"server_url" yaml:"server-url"`
+	KubectlUser              string `json:"kubectl_user" yaml:"kubectl-user"`
+	Provider                 string `json:"provider,omitempty" yaml:"provider,omitempty"`
+	Kubeconfig               string `json:"kubeconfig,omitempty" yaml:"kubeconfig,omitempty"`
+	Cluster                  string `json:"cluster,omitempty" yaml:"cluster,omitempty"`
+	ClusterServer            string `json:"cluster_server,omitempty" yaml:"cluster-server,omitempty"`
+	CertificateAuthorityData string `json:"certificate_authority_data,omitempty" yaml:"certificate-authority-data,omitempty"`
+	Context                  string `json:"context,omitempty" yaml:"context,omitempty"`
+	Namespace                string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	SetCurrentContext        bool   `json:"set_current_context,omitempty" yaml:"set-current-context,omitempty"`
+	HasRefreshToken          bool   `json:"has_refresh_token" yaml:"has-refresh-token"`
+}
+
+func (config *Config) summary(aliasConfig *AliasConfig) aliasSummary {
+	return aliasSummary{
+		Alias:                    aliasConfig.Alias,
+		Default:                  aliasConfig.Alias == config.Default,
+		ServerURL:                aliasConfig.BaseURL,
+		KubectlUser:              aliasConfig.KubectlUser,
+		Provider:                 aliasConfig.Provider,
+		Kubeconfig:               aliasConfig.Kubeconfig,
+		Cluster:                  aliasConfig.Cluster,
+		ClusterServer:            aliasConfig.Server,
+		CertificateAuthorityData: aliasConfig.CertificateAuthorityData,
+		Context:                  aliasConfig.Context,
+		Namespace:                aliasConfig.Namespace,
+		SetCurrentContext:        aliasConfig.SetCurrentContext,
+		HasRefreshToken:          aliasConfig.RefreshToken != "",
+	}
+}
+
+func readConfigFile(onDiskFile string) (*Config, error) {
+	yamlFile, err := ioutil.ReadFile(onDiskFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config file, use the 'config' verb to create an alias")
+	}
+	var config Config
+	if err := yaml.Unmarshal(yamlFile, &config); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal yaml file")
+	}
+	return &config, nil
+}
+
+// the alias used by login, check and get-token when given neither an alias nor a server URL
+func (app *app) defaultAlias() string {
+	config, err := readConfigFile(app.filenameWithPath)
+	if err != nil {
+		return ""
+	}
+	return config.Default
+}
+
+func (config *Config) mustFindAlias(alias string) (*AliasConfig, error) {
+	aliasConfig, ok := config.aliasSearch(alias)
+	if !ok {
+		return nil, fmt.Errorf("Could not find the alias '%s', check spelling or use 'kubelogin config list' to see the aliases", alias)
+	}
+	return aliasConfig, nil
+}
+
+func (config *Config) listAliases(out io.Writer, output string) error {
+	switch output {
+	case jsonOutput:
+		summaries := make([]aliasSummary, 0, len(config.Aliases))
+		for _, aliasConfig := range config.Aliases {
+			summaries = append(summaries, config.summary(aliasConfig))
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summaries)
+	case tableOutput, "":
+		table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "DEFAULT\tALIAS\tSERVER URL\tKUBECTL USER\tCLUSTER") // nolint: errcheck
+		for _, aliasConfig := range config.Aliases {
+			marker := ""
+			if aliasConfig.Alias == config.Default {
+				marker = "*"
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", marker, aliasConfig.Alias, aliasConfig.BaseURL, aliasConfig.KubectlUser, aliasConfig.Cluster) // nolint: errcheck
+		}
+		return table.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q, use %s or %s", output, tableOutput, jsonOutput)
+	}
+}
+
+func (config *Config) showAlias(out io.Writer, alias, output string) error {
+	aliasConfig, err := config.mustFindAlias(alias)
+	if err != nil {
+		return err
+	}
+	summary := config.summary(aliasConfig)
+	switch output {
+	case jsonOutput:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summary)
+	case yamlOutput, "":
+		marshaled, err := yaml.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(marshaled)
+		return err
+	default:
+		return fmt.Errorf("unknown output format %q, use %s or %s", output, yamlOutput, jsonOutput)
+	}
+}
+
+func (config *Config) deleteAlias(alias string) error {
+	for index, aliasConfig := range config.Aliases {
+		if aliasConfig.Alias == alias {
+			config.Aliases = append(config.Aliases[:index], config.Aliases[index+1:]...)
+			if config.Default == alias {
+				config.Default = ""
+			}
+			return nil
+		}
+	}
+	_, err := config.mustFindAlias(alias)
+	return err
+}
+
+// The refresh token and every other setting move with the alias.
+func (config *Config) renameAlias(oldAlias, newAlias string) error {
+	aliasConfig, err := config.mustFindAlias(oldAlias)
+	if err != nil {
+		return err
+	}
+	if newAlias == "" {
+		return fmt.Errorf("the new alias name can't be empty")
+	}
+	if _, exists := config.aliasSearch(newAlias); exists {
+		return fmt.Errorf("the alias '%s' already exists, delete it first", newAlias)
+	}
+	aliasConfig.Alias = newAlias
+	if config.Default == oldAlias {
+		config.Default = newAlias
+	}
+	return nil
+}
+
+func (config *Config) setDefaultAlias(alias string) error {
+	if _, err := config.mustFindAlias(alias); err != nil {
+		return err
+	}
+	config.Default = alias
+	return nil
+}
+
+// Runs one of the config verbs that manage existing aliases. The ones that change something save the
+// file and say what they did.
+func (app *app) manageAliases(verb string, args []string, output string, out io.Writer) error {
+	wantArgs, ok := aliasVerbArgs[verb]
+	if !ok {
+		return fmt.Errorf("unknown config verb %q", verb)
+	}
+	if len(args) != wantArgs {
+		return fmt.Errorf("config %s takes %d alias names, got %d", verb, wantArgs, len(args))
+	}
+	if verb == "list" || verb == "show" {
+		config, err := readConfigFile(app.filenameWithPath)
+		if err != nil {
+			return err
+		}
+		if verb == "list" {
+			return config.listAliases(out, output)
+		}
+		return config.showAlias(out, args[0], output)
+	}
+	var done string
+	err := editConfigFile(app.filenameWithPath, func(config *Config) error {
+		if len(config.Aliases) == 0 {
+			return errors.New("there are no aliases, use the 'config' verb to create one")
+		}
+		switch verb {
+		case "delete":
+			done = fmt.Sprintf("Alias %s deleted", args[0])
+			return config.deleteAlias(args[0])
+		case "rename":
+			done = fmt.Sprintf("Alias %s renamed to %s", args[0], args[1])
+			return config.renameAlias(args[0], args[1])
+		default:
+			done = fmt.Sprintf("Alias %s is now the default", args[0])
+			return config.setDefaultAlias(args[0])
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, done) // nolint: errcheck
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestManageAliases(t *testing.T) {
+	Convey("manageAliases", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		var app app
+		app.filenameWithPath = filepath.Join(dir, ".kubeloginrc.yaml")
+		var config Config
+		config.appendAlias(AliasConfig{Alias: "prod", BaseURL: "https://kubelogin.example.com", KubectlUser: "prod_oidc", RefreshToken: "secret", KubectlContext: KubectlContext{Cluster: "prod"}})
+		config.appendAlias(AliasConfig{Alias: "dev", BaseURL: "https://kubelogin.example.com", KubectlUser: "dev_oidc"})
+		config.Default = "prod"
+		So(config.writeToFile(app.filenameWithPath), ShouldEqual, nil)
+		run := func(verb string, args ...string) (string, error) {
+			var out bytes.Buffer
+			err := app.manageAliases(verb, args, "", &out)
+			return out.String(), err
+		}
+		saved := func() *Config {
+			config, err := readConfigFile(app.filenameWithPath)
+			So(err, ShouldEqual, nil)
+			return config
+		}
+
+		Convey("list should show a table with the default marked", func() {
+			out, err := run("list")
+			So(err, ShouldEqual, nil)
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			So(len(lines), ShouldEqual, 3)
+			So(lines[0], ShouldStartWith, "DEFAULT")
+			So(strings.Fields(lines[1]), ShouldResemble, []string{"*", "prod", "https://kubelogin.example.com", "prod_oidc", "prod"})
+			So(strings.Fields(lines[2]), ShouldResemble, []string{"dev", "https://kubelogin.example.com", "dev_oidc"})
+		})
+		Convey("list should print JSON without the refresh token", func() {
+			var out bytes.Buffer
+			So(app.manageAliases("list", nil, jsonOutput, &out), ShouldEqual, nil)
+			So(out.String(), ShouldNotContainSubstring, "secret")
+			var summaries []aliasSummary
+			So(json.Unmarshal(out.Bytes(), &summaries), ShouldEqual, nil)
+			So(len(summaries), ShouldEqual, 2)
+			So(summaries[0].Default, ShouldBeTrue)
+			So(summaries[0].HasRefreshToken, ShouldBeTrue)
+			So(summaries[1].HasRefreshToken, ShouldBeFalse)
+		})
+		Convey("list should reject an unknown output format", func() {
+			So(app.manageAliases("list", nil, "xml", ioutil.Discard), ShouldNotEqual, nil)
+		})
+		Convey("show should print one alias", func() {
+			out, err := run("show", "prod")
+			So(err, ShouldEqual, nil)
+			So(out, ShouldContainSubstring, "kubectl-user: prod_oidc\n")
+			So(out, ShouldContainSubstring, "has-refresh-token: true\n")
+			So(out, ShouldNotContainSubstring, "secret")
+			_, err = run("show", "nope")
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("delete should remove the alias and clear the default if it was", func() {
+			out, err := run("delete", "prod")
+			So(err, ShouldEqual, nil)
+			So(out, ShouldEqual, "Alias prod deleted\n")
+			config := saved()
+			So(len(config.Aliases), ShouldEqual, 1)
+			So(config.Default, ShouldEqual, "")
+			_, err = run("delete", "prod")
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("rename should move the settings and the default to the new name", func() {
+			_, err := run("rename", "prod", "production")
+			So(err, ShouldEqual, nil)
+			config := saved()
+			So(config.Default, ShouldEqual, "production")
+			renamed, ok := config.aliasSearch("production")
+			So(ok, ShouldBeTrue)
+			So(renamed.RefreshToken, ShouldEqual, "secret")
+			_, ok = config.aliasSearch("prod")
+			So(ok, ShouldBeFalse)
+		})
+		Convey("rename should not overwrite another alias", func() {
+			_, err := run("rename", "prod", "dev")
+			So(err, ShouldNotEqual, nil)
+			So(len(saved().Aliases), ShouldEqual, 2)
+		})
+		Convey("set-default should only accept an existing alias", func() {
+			_, err := run("set-default", "dev")
+			So(err, ShouldEqual, nil)
+			So(saved().Default, ShouldEqual, "dev")
+			So(app.defaultAlias(), ShouldEqual, "dev")
+			_, err = run("set-default", "nope")
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("should insist on the right number of alias names", func() {
+			_, err := run("rename", "prod")
+			So(err, ShouldNotEqual, nil)
+			_, err = run("bogus")
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
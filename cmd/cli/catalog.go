@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// catalogCluster is one cluster published by the kubelogin server on /catalog
+type catalogCluster struct {
+	Alias                    string `json:"alias"`
+	KubectlUser              string `json:"kubectl_user"`
+	Provider                 string `json:"provider"`
+	Cluster                  string `json:"cluster"`
+	Server                   string `json:"server"`
+	CertificateAuthorityData string `json:"certificate_authority_data"`
+	Context                  string `json:"context"`
+	Namespace                string `json:"namespace"`
+	Description              string `json:"description"`
+}
+
+type catalog struct {
+	Clusters []catalogCluster `json:"clusters"`
+}
+
+func fetchCatalog(serverURL string) (*catalog, error) {
+	req, err := http.NewRequest("GET", serverURL+"/catalog", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch the cluster catalog")
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("kubelogin server at %s does not publish a cluster catalog", serverURL)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch the cluster catalog: kubelogin server returned %s", res.Status)
+	}
+	var fetched catalog
+	if err := json.NewDecoder(res.Body).Decode(&fetched); err != nil {
+		return nil, errors.Wrap(err, "failed to decode the cluster catalog")
+	}
+	return &fetched, nil
+}
+
+// aliasConfig is the alias the catalog asks for, logging in through the server the catalog came from
+func (cluster catalogCluster) aliasConfig(serverURL string) AliasConfig {
+	return AliasConfig{
+		Alias:       cluster.Alias,
+		BaseURL:     serverURL,
+		KubectlUser: cluster.KubectlUser,
+		Provider:    cluster.Provider,
+		KubectlContext: KubectlContext{
+			Cluster:                  cluster.Cluster,
+			Server:                   cluster.Server,
+			CertificateAuthorityData: cluster.CertificateAuthorityData,
+			Context:                  cluster.Context,
+			Namespace:                cluster.Namespace,
+		},
+	}
+}
+
+func (cluster catalogCluster) describe() string {
+	if cluster.Description == "" {
+		return ""
+	}
+	return " (" + cluster.Description + ")"
+}
+
+// Adds or updates an alias for every cluster in the catalog, or only the named ones if any are given, and
+// returns a line for each saying what happened. Settings that only make sense on this machine, like the
+// refresh token, kube config file and whether to switch the current context, are left as they were. The
+// refresh token is only kept while the server and provider stay the same, since no other one would take it.
+func (config *Config) importCatalog(fetched *catalog, serverURL string, only []string) ([]string, error) {
+	wanted := map[string]bool{}
+	for _, alias := range only {
+		wanted[alias] = true
+	}
+	found := map[string]bool{}
+	var report []string
+	for _, cluster := range fetched.Clusters {
+		if len(only) > 0 && !wanted[cluster.Alias] {
+			continue
+		}
+		found[cluster.Alias] = true
+		imported := cluster.aliasConfig(serverURL)
+		if imported.Alias == "" || imported.KubectlUser == "" {
+			return nil, fmt.Errorf("the catalog has a cluster without an alias or kubectl user")
+		}
+		if err := imported.KubectlContext.validate(); err != nil {
+			return nil, errors.Wrapf(err, "the catalog entry for %s is invalid", imported.Alias)
+		}
+		existing, ok := config.aliasSearch(imported.Alias)
+		if !ok {
+			config.appendAlias(imported)
+			report = append(report, fmt.Sprintf("Added alias %s for cluster %s%s", imported.Alias, imported.Cluster, cluster.describe()))
+			continue
+		}
+		if imported.BaseURL == existing.BaseURL && imported.Provider == existing.Provider {
+			imported.RefreshToken = existing.RefreshToken
+		}
+		imported.Kubeconfig = existing.Kubeconfig
+		imported.SetCurrentContext = existing.SetCurrentContext
+		if *existing == imported {
+			report = append(report, fmt.Sprintf("Alias %s is up to date", imported.Alias))
+			continue
+		}
+		*existing = imported
+		report = append(report, fmt.Sprintf("Updated alias %s for cluster %s%s", imported.Alias, imported.Cluster, cluster.describe()))
+	}
+	for _, alias := range only {
+		if !found[alias] {
+			return nil, fmt.Errorf("the catalog has no cluster with the alias %s", alias)
+		}
+	}
+	return report, nil
+}
+
+// Pulls the catalog from the server and saves the aliases in the kubeloginrc file, creating it if needed.
+func (app *app) importCatalog(serverURL string, only []string, out io.Writer) error {
+	fetched, err := fetchCatalog(serverURL)
+	if err != nil {
+		return err
+	}
+	if len(fetched.Clusters) == 0 {
+		fmt.Fprintln(out, "The catalog is empty") // nolint: errcheck
+		return nil
+	}
+	var report []string
+	err = editConfigFile(app.filenameWithPath, func(config *Config) error {
+		report, err = config.importCatalog(fetched, serverURL, only)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, line := range report {
+		fmt.Fprintln(out, line) // nolint: errcheck
+	}
+	return nil
+}
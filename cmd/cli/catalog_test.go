@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestImportCatalog(t *testing.T) {
+	Convey("importCatalog", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		published := catalog{Clusters: []catalogCluster{
+			{Alias: "prod", KubectlUser: "prod_oidc", Cluster: "prod", Server: "https://prod.example.com", Description: "Production"},
+			{Alias: "dev", KubectlUser: "dev_oidc", Provider: "partners", Cluster: "dev", Server: "https://dev.example.com", Namespace: "team"},
+		}}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/catalog" {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(published) // nolint: errcheck
+		}))
+		defer server.Close()
+		var app app
+		app.filenameWithPath = filepath.Join(dir, ".kubeloginrc.yaml")
+
+		Convey("should create the config file with an alias for each cluster", func() {
+			var out bytes.Buffer
+			So(app.importCatalog(server.URL, nil, &out), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, "Added alias prod for cluster prod (Production)\nAdded alias dev for cluster dev\n")
+			So(app.getConfigSettings("dev"), ShouldEqual, nil)
+			So(app.kubeloginServer, ShouldEqual, server.URL)
+			So(app.kubectlUser, ShouldEqual, "dev_oidc")
+			So(app.provider, ShouldEqual, "partners")
+			So(app.kubectlContext, ShouldResemble, KubectlContext{Cluster: "dev", Server: "https://dev.example.com", Namespace: "team"})
+		})
+		Convey("should update changed aliases and keep what only this machine knows", func() {
+			var config Config
+			config.appendAlias(AliasConfig{Alias: "prod", BaseURL: server.URL, KubectlUser: "old_oidc", RefreshToken: "refresh", KubectlContext: KubectlContext{SetCurrentContext: true}})
+			config.appendAlias(published.Clusters[1].aliasConfig(server.URL))
+			config.appendAlias(AliasConfig{Alias: "mine", BaseURL: "https://other.example.com", KubectlUser: "me"})
+			So(config.writeToFile(app.filenameWithPath), ShouldEqual, nil)
+			var out bytes.Buffer
+			So(app.importCatalog(server.URL, nil, &out), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, "Updated alias prod for cluster prod (Production)\nAlias dev is up to date\n")
+			So(app.getConfigSettings("prod"), ShouldEqual, nil)
+			So(app.kubectlUser, ShouldEqual, "prod_oidc")
+			So(app.refreshToken, ShouldEqual, "refresh")
+			So(app.kubectlContext.SetCurrentContext, ShouldBeTrue)
+			So(app.getConfigSettings("mine"), ShouldEqual, nil)
+		})
+		Convey("should drop the refresh token when the server or provider changes", func() {
+			var config Config
+			config.appendAlias(AliasConfig{Alias: "prod", BaseURL: "https://old.example.com", KubectlUser: "prod_oidc", RefreshToken: "refresh"})
+			config.appendAlias(AliasConfig{Alias: "dev", BaseURL: server.URL, KubectlUser: "dev_oidc", RefreshToken: "refresh"})
+			So(config.writeToFile(app.filenameWithPath), ShouldEqual, nil)
+			So(app.importCatalog(server.URL, nil, ioutil.Discard), ShouldEqual, nil)
+			So(app.getConfigSettings("prod"), ShouldEqual, nil)
+			So(app.refreshToken, ShouldEqual, "")
+			So(app.getConfigSettings("dev"), ShouldEqual, nil)
+			So(app.provider, ShouldEqual, "partners")
+			So(app.refreshToken, ShouldEqual, "")
+		})
+		Convey("should only import the aliases asked for", func() {
+			var out bytes.Buffer
+			So(app.importCatalog(server.URL, []string{"dev"}, &out), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, "Added alias dev for cluster dev\n")
+			So(app.getConfigSettings("prod"), ShouldNotEqual, nil)
+		})
+		Convey("should fail on an alias the catalog doesn't have", func() {
+			So(app.importCatalog(server.URL, []string{"dev", "nope"}, ioutil.Discard), ShouldNotEqual, nil)
+			_, err := os.Stat(app.filenameWithPath)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+		Convey("should fail when the server has no catalog", func() {
+			So(app.importCatalog(server.URL+"/nothing", nil, ioutil.Discard), ShouldNotEqual, nil)
+		})
+	})
+}
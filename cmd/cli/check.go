@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the states check can find a token in
+const (
+	tokenFresh       = "fresh"
+	tokenExpired     = "expired"
+	tokenExpiring    = "expiring"
+	tokenMissingUser = "missing-user"
+	tokenNotJWT      = "not-a-jwt"
+	tokenMalformed   = "malformed"
+	tokenNotYetValid = "not-yet-valid"
+)
+
+// check exits with a code of its own for each state. A stale token exits with 1, as it always has.
+var checkExitCodes = map[string]int{
+	tokenFresh:       0,
+	tokenExpired:     1,
+	tokenExpiring:    2,
+	tokenMissingUser: 3,
+	tokenNotJWT:      4,
+	tokenMalformed:   5,
+	tokenNotYetValid: 6,
+}
+
+// how far this machine's clock may be behind the provider's when reading nbf and iat
+const defaultClockSkew = 30 * time.Second
+
+// tokenCheck is what check found out about the token of the kubectl user
+type tokenCheck struct {
+	KubectlUser string     `json:"kubectl_user"`
+	State       string     `json:"state"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Remaining   string     `json:"remaining,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+}
+
+// Pure function judging a JWT as of now. The token is only fresh if it outlives minValid; nbf and iat may be
+// up to clockSkew ahead, since this clock may be behind the provider's. The skew leaves exp alone, so a
+// token counts as expired exactly when it does for kubectl.
+func checkJWT(jwt string, minValid, clockSkew time.Duration, now time.Time) tokenCheck {
+	var check tokenCheck
+	claims, err := decodeJWTPayload(jwt)
+	if err == nil && strings.Count(jwt, ".") != 2 {
+		err = fmt.Errorf("JWT not in proper format")
+	}
+	if err != nil {
+		check.State, check.Reason = tokenNotJWT, fmt.Sprintf("token is not a JWT: %v", err)
+		return check
+	}
+	check.ExpiresAt = timeClaim(claims["exp"])
+	if check.ExpiresAt == nil {
+		check.State, check.Reason = tokenMalformed, "JWT has no numeric exp claim"
+		return check
+	}
+	for _, claim := range []string{"nbf", "iat"} {
+		value, ok := claims[claim]
+		if !ok {
+			continue
+		}
+		validFrom := timeClaim(value)
+		if validFrom == nil {
+			check.State, check.Reason = tokenMalformed, fmt.Sprintf("JWT %s claim is not a number", claim)
+			return check
+		}
+		if validFrom.After(now.Add(clockSkew)) {
+			check.State, check.Reason = tokenNotYetValid, fmt.Sprintf("JWT %s claim is %s, in the future", claim, validFrom.Local().Format(time.RFC3339))
+			return check
+		}
+	}
+	remaining := check.ExpiresAt.Sub(now)
+	switch {
+	case remaining <= 0:
+		check.State = tokenExpired
+	case remaining < minValid:
+		check.State = tokenExpiring
+	default:
+		check.State = tokenFresh
+	}
+	if remaining > 0 {
+		check.Remaining = remaining.Round(time.Second).String()
+	}
+	return check
+}
+
+// Checks the token in the kube config section pointed to by the app. Only a kube config that can't be
+// read is an error; everything wrong with the token itself is a state.
+func (app *app) checkToken(minValid, clockSkew time.Duration) (tokenCheck, error) {
+	jwt, err := app.kubeconfigToken()
+	if errors.Cause(err) == errUserNotFound {
+		return tokenCheck{KubectlUser: app.kubectlUser, State: tokenMissingUser, Reason: err.Error()}, nil
+	}
+	if err != nil {
+		return tokenCheck{}, err
+	}
+	check := checkJWT(jwt, minValid, clockSkew, time.Now())
+	check.KubectlUser = app.kubectlUser
+	return check, nil
+}
+
+func writeCheck(out io.Writer, check tokenCheck, output string) error {
+	switch output {
+	case jsonOutput:
+		return json.NewEncoder(out).Encode(check)
+	case "":
+		line := fmt.Sprintf("Token of %s is %s", check.KubectlUser, check.State)
+		if check.Remaining != "" {
+			line += fmt.Sprintf(", %s left", check.Remaining)
+		}
+		if check.Reason != "" {
+			line += ": " + check.Reason
+		}
+		_, err := fmt.Fprintln(out, line)
+		return err
+	default:
+		return fmt.Errorf("unknown output format %q, use %s or leave it out", output, jsonOutput)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCheckJWT(t *testing.T) {
+	Convey("checkJWT", t, func() {
+		now := time.Unix(1500000000, 0)
+		withClaims := func(claims map[string]interface{}) tokenCheck {
+			return checkJWT(fakeJWT(claims), 5*time.Minute, 30*time.Second, now)
+		}
+		Convey("should report a fresh token with its remaining lifetime", func() {
+			check := withClaims(map[string]interface{}{"iat": 1499999000, "nbf": 1499999000, "exp": 1500003600})
+			So(check.State, ShouldEqual, tokenFresh)
+			So(check.Remaining, ShouldEqual, "1h0m0s")
+			So(check.ExpiresAt.Unix(), ShouldEqual, 1500003600)
+		})
+		Convey("should report a token expiring within the minimum validity", func() {
+			So(withClaims(map[string]interface{}{"exp": 1500000290}).State, ShouldEqual, tokenExpiring)
+			So(withClaims(map[string]interface{}{"exp": 1500000310}).State, ShouldEqual, tokenFresh)
+		})
+		Convey("should not apply the clock skew to exp", func() {
+			So(checkJWT(fakeJWT(map[string]interface{}{"exp": 1500000003}), 0, 30*time.Second, now).State, ShouldEqual, tokenFresh)
+		})
+		Convey("should report an expired token", func() {
+			check := withClaims(map[string]interface{}{"exp": 1499999999})
+			So(check.State, ShouldEqual, tokenExpired)
+			So(check.Remaining, ShouldEqual, "")
+		})
+		Convey("should tolerate nbf and iat within the clock skew but not beyond", func() {
+			So(withClaims(map[string]interface{}{"iat": 1500000020, "exp": 1500003600}).State, ShouldEqual, tokenFresh)
+			So(withClaims(map[string]interface{}{"nbf": 1500000600, "exp": 1500003600}).State, ShouldEqual, tokenNotYetValid)
+		})
+		Convey("should tell a token that isn't a JWT from a JWT with bad claims", func() {
+			So(checkJWT("garbage", 0, 0, now).State, ShouldEqual, tokenNotJWT)
+			So(checkJWT("e30.e30", 0, 0, now).State, ShouldEqual, tokenNotJWT)
+			So(withClaims(map[string]interface{}{"sub": "someone"}).State, ShouldEqual, tokenMalformed)
+			So(withClaims(map[string]interface{}{"exp": 1500003600, "iat": "yesterday"}).State, ShouldEqual, tokenMalformed)
+		})
+	})
+}
+
+func TestCheckToken(t *testing.T) {
+	Convey("checkToken", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		var app app
+		app.kubectlConfigPaths = []string{filepath.Join(dir, "config")}
+		jwt := fakeJWT(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()})
+		So(ioutil.WriteFile(app.kubectlConfigPaths[0], []byte("users:\n- name: prod_oidc\n  user:\n    token: "+jwt+"\n"), 0600), ShouldEqual, nil)
+		Convey("should check the token of the user", func() {
+			app.kubectlUser = "prod_oidc"
+			check, err := app.checkToken(0, defaultClockSkew)
+			So(err, ShouldEqual, nil)
+			So(check.KubectlUser, ShouldEqual, "prod_oidc")
+			So(check.State, ShouldEqual, tokenFresh)
+			check, err = app.checkToken(2*time.Hour, defaultClockSkew)
+			So(err, ShouldEqual, nil)
+			So(check.State, ShouldEqual, tokenExpiring)
+		})
+		Convey("should report a missing user as a state", func() {
+			app.kubectlUser = "other_oidc"
+			check, err := app.checkToken(0, defaultClockSkew)
+			So(err, ShouldEqual, nil)
+			So(check.State, ShouldEqual, tokenMissingUser)
+			So(checkExitCodes[check.State], ShouldEqual, 3)
+		})
+		Convey("should fail when there is no kube config to read", func() {
+			app.kubectlConfigPaths = []string{filepath.Join(dir, "missing")}
+			_, err := app.checkToken(0, defaultClockSkew)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestWriteCheck(t *testing.T) {
+	Convey("writeCheck", t, func() {
+		check := tokenCheck{KubectlUser: "prod_oidc", State: tokenExpiring, Remaining: "2m0s"}
+		Convey("should write a line for people", func() {
+			var out bytes.Buffer
+			So(writeCheck(&out, check, ""), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, "Token of prod_oidc is expiring, 2m0s left\n")
+		})
+		Convey("should write JSON for scripts", func() {
+			var out bytes.Buffer
+			So(writeCheck(&out, check, jsonOutput), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, `{"kubectl_user":"prod_oidc","state":"expiring","remaining":"2m0s"}`+"\n")
+		})
+		Convey("should refuse other formats", func() {
+			So(writeCheck(ioutil.Discard, check, yamlOutput), ShouldNotEqual, nil)
+		})
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// RFC 8628 says to poll every 5 seconds when the server doesn't say otherwise, and to add 5 on slow_down
+	defaultDevicePollInterval = 5 * time.Second
+	slowDownIncrement         = 5 * time.Second
+)
+
+// swapped out in tests so polling doesn't take real time
+var sleep = time.Sleep
+
+// deviceAuthorization is the kubelogin server's answer to /device/code
+type deviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// deviceTokenResponse carries either the tokens or the reason the login isn't finished yet
+type deviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+}
+
+func postForm(endpoint string, form url.Values, value interface{}) error {
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	// the token endpoint reports a pending login as a 400 with an error code in the body
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("kubelogin server returned %s", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(value); err != nil {
+		return errors.Wrap(err, "failed to decode kubelogin server response")
+	}
+	return nil
+}
+
+func (app *app) startDeviceAuthorization() (*deviceAuthorization, error) {
+	var authorization deviceAuthorization
+	form := url.Values{}
+	if app.provider != "" {
+		form.Set(providerField, app.provider)
+	}
+	if err := postForm(app.kubeloginServer+"/device/code", form, &authorization); err != nil {
+		return nil, errors.Wrap(err, "failed to start device login")
+	}
+	if authorization.DeviceCode == "" || authorization.UserCode == "" {
+		return nil, fmt.Errorf("kubelogin server did not return a device code")
+	}
+	return &authorization, nil
+}
+
+// Logs in without a local listener: the user opens the printed URL on any machine with a browser while this
+// polls the server until the login is finished.
+func (app *app) deviceLogin(out io.Writer) error {
+	authorization, err := app.startDeviceAuthorization()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "To log in, open %s in a browser and enter the code %s\n", authorization.VerificationURI, authorization.UserCode) // nolint: errcheck
+	if authorization.VerificationURIComplete != "" {
+		fmt.Fprintf(out, "Or open %s\n", authorization.VerificationURIComplete) // nolint: errcheck
+	}
+
+	interval := time.Duration(authorization.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDevicePollInterval
+	}
+	deadline := time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+	form := url.Values{}
+	form.Set("grant_type", deviceGrantType)
+	form.Set("device_code", authorization.DeviceCode)
+	for time.Now().Before(deadline) {
+		sleep(interval)
+		var tokens deviceTokenResponse
+		if err := postForm(app.kubeloginServer+"/device/token", form, &tokens); err != nil {
+			return errors.Wrap(err, "failed to poll for the device login")
+		}
+		switch tokens.Error {
+		case "":
+			if tokens.AccessToken == "" {
+				return fmt.Errorf("kubelogin server did not return a token")
+			}
+			if err := app.saveToken(tokens.AccessToken); err != nil {
+				return err
+			}
+			return app.saveRefreshToken(tokens.RefreshToken)
+		case "authorization_pending":
+		case "slow_down":
+			interval += slowDownIncrement
+		case "access_denied":
+			return fmt.Errorf("the login was denied")
+		case "expired_token":
+			return fmt.Errorf("the code expired before the login was completed")
+		default:
+			return fmt.Errorf("device login failed: %s", tokens.Error)
+		}
+	}
+	return fmt.Errorf("the code expired before the login was completed")
+}
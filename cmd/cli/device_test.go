@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeviceLogin(t *testing.T) {
+	Convey("deviceLogin", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		var slept []time.Duration
+		sleep = func(d time.Duration) { slept = append(slept, d) }
+		defer func() { sleep = time.Sleep }()
+
+		// answers each poll with the next of these; an empty string hands out the token
+		var polls []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/device/code":
+				json.NewEncoder(w).Encode(deviceAuthorization{ // nolint: errcheck
+					DeviceCode:      "device",
+					UserCode:        "BCDF-GHJK",
+					VerificationURI: "https://kubelogin.example.com/device",
+					ExpiresIn:       600,
+					Interval:        1,
+				})
+			case "/device/token":
+				if r.FormValue("grant_type") != deviceGrantType || r.FormValue("device_code") != "device" {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"error":"invalid_request"}`)) // nolint: errcheck
+					return
+				}
+				next := polls[0]
+				polls = polls[1:]
+				if next != "" {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(map[string]string{"error": next}) // nolint: errcheck
+					return
+				}
+				w.Write([]byte(`{"access_token":"jwt","token_type":"Bearer"}`)) // nolint: errcheck
+			}
+		}))
+		defer server.Close()
+		var app app
+		app.kubeloginServer = server.URL
+		app.kubectlUser = "test"
+		app.execCredential = true
+		app.tokenCacheDir = dir
+
+		Convey("should print the code and save the token once the login is done", func() {
+			polls = []string{"authorization_pending", "slow_down", ""}
+			var out bytes.Buffer
+			So(app.deviceLogin(&out), ShouldEqual, nil)
+			So(out.String(), ShouldContainSubstring, "BCDF-GHJK")
+			cached, err := app.readTokenCache()
+			So(err, ShouldEqual, nil)
+			So(cached, ShouldEqual, "jwt")
+			So(slept, ShouldResemble, []time.Duration{time.Second, time.Second, 6 * time.Second})
+		})
+		Convey("should return an error if the login is denied", func() {
+			polls = []string{"access_denied"}
+			So(app.deviceLogin(ioutil.Discard), ShouldNotEqual, nil)
+		})
+		Convey("should return an error if the code expires", func() {
+			polls = []string{"authorization_pending", "expired_token"}
+			So(app.deviceLogin(ioutil.Discard), ShouldNotEqual, nil)
+		})
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// exit codes of ensure, so that scripts can tell what it had to do to get a fresh token. A failed login
+// exits like it does for login.
+const (
+	ensureFresh     = 0
+	ensureFailed    = 1
+	ensureRefreshed = 2
+	ensureLoggedIn  = 3
+)
+
+const defaultMinValid = 5 * time.Minute
+
+// Makes sure the token kubectl uses stays valid for at least minValid: a token that will is left alone, then
+// the refresh token is tried, and only then login is run. When the kube config runs kubelogin as a credential
+// plugin the token is the one get-token caches, and refreshing or logging in saves it there; otherwise it is
+// the one in the kube config. Returns the exit code saying which of these it took.
+func (app *app) ensure(minValid, clockSkew time.Duration, login func() error, out io.Writer) (int, error) {
+	app.execCredential = app.execCredential || app.kubeconfigRunsPlugin()
+	if fresh, err := app.ensuredTokenFresh(minValid, clockSkew); err == nil && fresh {
+		fmt.Fprintf(out, "Your token is valid for at least %s\n", minValid) // nolint: errcheck
+		return ensureFresh, nil
+	}
+	if app.refreshWithoutBrowser() {
+		fresh, err := app.ensuredTokenFresh(minValid, clockSkew)
+		if err != nil {
+			return ensureFailed, err
+		}
+		if fresh {
+			fmt.Fprintln(out, "Your token has been refreshed! Enjoy kubectl-ing!") // nolint: errcheck
+			return ensureRefreshed, nil
+		}
+		// the provider hands out tokens shorter lived than asked for, only a new login can do better
+	}
+	if err := login(); err != nil {
+		return ensureFailed, err
+	}
+	fresh, err := app.ensuredTokenFresh(minValid, clockSkew)
+	if err != nil {
+		return ensureFailed, err
+	}
+	if !fresh {
+		return ensureFailed, fmt.Errorf("logged in, but the new token isn't valid for %s; ask for a shorter --min-valid", minValid)
+	}
+	fmt.Fprintln(out, "You are now logged in! Enjoy kubectl-ing!") // nolint: errcheck
+	return ensureLoggedIn, nil
+}
+
+// whether the token ensure looks after, in the get-token cache or the kube config, stays valid for minValid
+func (app *app) ensuredTokenFresh(minValid, clockSkew time.Duration) (bool, error) {
+	if app.execCredential {
+		jwt, err := app.readTokenCache()
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return checkJWT(jwt, minValid, clockSkew, time.Now()).State == tokenFresh, nil
+	}
+	check, err := app.checkToken(minValid, clockSkew)
+	if err != nil {
+		return false, err
+	}
+	return check.State == tokenFresh, nil
+}
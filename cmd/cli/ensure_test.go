@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEnsure(t *testing.T) {
+	Convey("ensure", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		expiringIn := func(d time.Duration) string {
+			return fakeJWT(map[string]interface{}{"exp": time.Now().Add(d).Unix()})
+		}
+		refreshed := expiringIn(3 * time.Hour)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.PostFormValue("refresh_token") != "refresh" {
+				http.Error(w, "no", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(tokenResponse{Token: refreshed}) // nolint: errcheck
+		}))
+		defer server.Close()
+		var app app
+		app.kubectlUser = "prod_oidc"
+		app.kubeloginServer = server.URL
+		app.kubectlConfigPaths = []string{filepath.Join(dir, "config")}
+		So(ioutil.WriteFile(app.kubectlConfigPaths[0], []byte("users:\n- name: prod_oidc\n  user:\n    token: "+expiringIn(time.Hour)+"\n"), 0600), ShouldEqual, nil)
+		logins := 0
+		loggedIn := expiringIn(3 * time.Hour)
+		login := func() error {
+			logins++
+			return app.saveToken(loggedIn)
+		}
+
+		Convey("should leave a token that stays valid long enough alone", func() {
+			code, err := app.ensure(30*time.Minute, 0, login, ioutil.Discard)
+			So(err, ShouldEqual, nil)
+			So(code, ShouldEqual, ensureFresh)
+			So(logins, ShouldEqual, 0)
+		})
+		Convey("with kubectl running get-token", func() {
+			kubeconfig := "users:\n- name: prod_oidc\n  user:\n    exec:\n      command: kubelogin\n"
+			So(ioutil.WriteFile(app.kubectlConfigPaths[0], []byte(kubeconfig), 0600), ShouldEqual, nil)
+			app.tokenCacheDir = filepath.Join(dir, "cache")
+			Convey("should leave a fresh cached token alone", func() {
+				So(app.writeTokenCache(expiringIn(3*time.Hour)), ShouldEqual, nil)
+				code, err := app.ensure(2*time.Hour, 0, login, ioutil.Discard)
+				So(err, ShouldEqual, nil)
+				So(code, ShouldEqual, ensureFresh)
+				So(logins, ShouldEqual, 0)
+			})
+			Convey("should refresh into the cache and leave the kube config alone", func() {
+				So(app.writeTokenCache(expiringIn(time.Hour)), ShouldEqual, nil)
+				app.refreshToken = "refresh"
+				code, err := app.ensure(2*time.Hour, 0, login, ioutil.Discard)
+				So(err, ShouldEqual, nil)
+				So(code, ShouldEqual, ensureRefreshed)
+				cached, _ := app.readTokenCache()
+				So(cached, ShouldEqual, refreshed)
+				contents, _ := ioutil.ReadFile(app.kubectlConfigPaths[0])
+				So(string(contents), ShouldEqual, kubeconfig)
+			})
+			Convey("should log in into the cache when there is no cached token", func() {
+				code, err := app.ensure(2*time.Hour, 0, login, ioutil.Discard)
+				So(err, ShouldEqual, nil)
+				So(code, ShouldEqual, ensureLoggedIn)
+				cached, _ := app.readTokenCache()
+				So(cached, ShouldEqual, loggedIn)
+				contents, _ := ioutil.ReadFile(app.kubectlConfigPaths[0])
+				So(string(contents), ShouldEqual, kubeconfig)
+			})
+		})
+		Convey("should refresh a token expiring too soon without logging in", func() {
+			app.refreshToken = "refresh"
+			code, err := app.ensure(2*time.Hour, 0, login, ioutil.Discard)
+			So(err, ShouldEqual, nil)
+			So(code, ShouldEqual, ensureRefreshed)
+			So(logins, ShouldEqual, 0)
+			jwt, _ := app.kubeconfigToken()
+			So(jwt, ShouldEqual, refreshed)
+		})
+		Convey("should log in when the refresh token is refused", func() {
+			app.refreshToken = "revoked"
+			code, err := app.ensure(2*time.Hour, 0, login, ioutil.Discard)
+			So(err, ShouldEqual, nil)
+			So(code, ShouldEqual, ensureLoggedIn)
+			So(logins, ShouldEqual, 1)
+		})
+		Convey("should log in when there is no token at all", func() {
+			app.kubectlUser = "other_oidc"
+			code, err := app.ensure(0, 0, login, ioutil.Discard)
+			So(err, ShouldEqual, nil)
+			So(code, ShouldEqual, ensureLoggedIn)
+		})
+		Convey("should allow for the clock skew given", func() {
+			ahead := fakeJWT(map[string]interface{}{"exp": time.Now().Add(3 * time.Hour).Unix(), "nbf": time.Now().Add(10 * time.Minute).Unix()})
+			So(app.saveToken(ahead), ShouldEqual, nil)
+			code, err := app.ensure(0, 15*time.Minute, login, ioutil.Discard)
+			So(err, ShouldEqual, nil)
+			So(code, ShouldEqual, ensureFresh)
+			code, err = app.ensure(0, 0, login, ioutil.Discard)
+			So(err, ShouldEqual, nil)
+			So(code, ShouldEqual, ensureLoggedIn)
+		})
+		Convey("should fail when the login hands out a token that isn't valid long enough", func() {
+			loggedIn = expiringIn(time.Hour)
+			code, err := app.ensure(2*time.Hour, 0, login, ioutil.Discard)
+			So(err, ShouldNotEqual, nil)
+			So(code, ShouldEqual, ensureFailed)
+			So(logins, ShouldEqual, 1)
+		})
+		Convey("should fail when the login does", func() {
+			code, err := app.ensure(2*time.Hour, 0, func() error { return errors.New("denied") }, ioutil.Discard)
+			So(err, ShouldNotEqual, nil)
+			So(code, ShouldEqual, ensureFailed)
+		})
+	})
+}
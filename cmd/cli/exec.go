@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	execCredentialKind    = "ExecCredential"
+	execCredentialV1      = "client.authentication.k8s.io/v1"
+	execCredentialV1beta1 = "client.authentication.k8s.io/v1beta1"
+	kubernetesExecInfoEnv = "KUBERNETES_EXEC_INFO"
+	tokenCacheFileSuffix  = ".token"
+	tokenCacheDirMode     = 0700
+	tokenCacheFileMode    = 0600
+	// a cached token this close to expiring could expire while kubectl's request is in flight
+	cachedTokenMargin = time.Minute
+)
+
+// execCredential is the subset of the client-go ExecCredential object that kubelogin reads and writes.
+// See https://kubernetes.io/docs/reference/access-authn-authz/authentication/#client-go-credential-plugins
+type execCredential struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Status     *execCredentialStatus `json:"status,omitempty"`
+}
+
+type execCredentialStatus struct {
+	ExpirationTimestamp string `json:"expirationTimestamp,omitempty"`
+	Token               string `json:"token"`
+}
+
+// Picks the ExecCredential apiVersion to answer with. client-go passes the version it expects in the
+// KUBERNETES_EXEC_INFO environment variable; older clients don't, so we fall back to the flag value.
+func execCredentialAPIVersion(execInfo, fallback string) (string, error) {
+	apiVersion := fallback
+	if execInfo != "" {
+		var info execCredential
+		if err := json.Unmarshal([]byte(execInfo), &info); err != nil {
+			return "", errors.Wrapf(err, "could not parse %s", kubernetesExecInfoEnv)
+		}
+		if info.APIVersion != "" {
+			apiVersion = info.APIVersion
+		}
+	}
+	switch apiVersion {
+	case execCredentialV1, execCredentialV1beta1:
+		return apiVersion, nil
+	}
+	return "", fmt.Errorf("unsupported ExecCredential apiVersion %q, expected %s or %s", apiVersion, execCredentialV1, execCredentialV1beta1)
+}
+
+// Pure function to build the ExecCredential handed back to kubectl
+func newExecCredential(apiVersion, jwt string, expiry time.Time) execCredential {
+	status := &execCredentialStatus{Token: jwt}
+	if !expiry.IsZero() {
+		status.ExpirationTimestamp = expiry.UTC().Format(time.RFC3339)
+	}
+	return execCredential{
+		APIVersion: apiVersion,
+		Kind:       execCredentialKind,
+		Status:     status,
+	}
+}
+
+// The cache file is keyed on the server, the user and the named provider so that two aliases sharing a
+// kubectl user name against different kubelogin servers or identity providers don't trample each other.
+// The default provider adds nothing, which keeps the files cached before there were named providers.
+func (app *app) tokenCachePath() string {
+	key := app.kubeloginServer + "\n" + app.kubectlUser
+	if app.provider != "" {
+		key += "\n" + app.provider
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(app.tokenCacheDir, fmt.Sprintf("%x%s", sum, tokenCacheFileSuffix))
+}
+
+func (app *app) readTokenCache() (string, error) {
+	cached, err := ioutil.ReadFile(app.tokenCachePath())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(cached)), nil
+}
+
+func (app *app) writeTokenCache(jwt string) error {
+	if err := os.MkdirAll(app.tokenCacheDir, tokenCacheDirMode); err != nil {
+		return errors.Wrap(err, "failed to create token cache directory")
+	}
+	if err := ioutil.WriteFile(app.tokenCachePath(), []byte(jwt), tokenCacheFileMode); err != nil {
+		return errors.Wrap(err, "failed to write token cache")
+	}
+	return nil
+}
+
+// Returns the cached JWT if it stays valid for at least the margin, otherwise an empty string.
+func (app *app) freshCachedToken(margin time.Duration) (string, time.Time) {
+	jwt, err := app.readTokenCache()
+	if err != nil || jwt == "" {
+		return "", time.Time{}
+	}
+	expiry, err := parseJWTExpiry(jwt)
+	if err != nil || !expiry.After(time.Now().Add(margin)) {
+		return "", time.Time{}
+	}
+	return jwt, expiry
+}
+
+// Writes an ExecCredential for kubectl to the writer. A missing or stale cached token is refreshed if the
+// alias has a refresh token, and only then do we go through the browser login.
+func (app *app) getToken(writer io.Writer, apiVersion string) error {
+	jwt, expiry := app.freshCachedToken(cachedTokenMargin)
+	if jwt == "" {
+		if !app.refreshWithoutBrowser() {
+			if err := generateURLAndListenForServerResponse(*app); err != nil {
+				return err
+			}
+		}
+		// a token just handed out is used even if the provider issues them shorter lived than the margin
+		jwt, expiry = app.freshCachedToken(0)
+		if jwt == "" {
+			return fmt.Errorf("no valid token for %s after logging in", app.kubectlUser)
+		}
+	}
+	return json.NewEncoder(writer).Encode(newExecCredential(apiVersion, jwt, expiry))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Builds an unsigned JWT carrying the given claims; only the payload matters to the CLI.
+func fakeJWT(claims map[string]interface{}) string {
+	payload, _ := json.Marshal(claims)
+	return fmt.Sprintf("e30.%s.c2ln", base64.RawURLEncoding.EncodeToString(payload))
+}
+
+func TestExecCredentialAPIVersion(t *testing.T) {
+	Convey("execCredentialAPIVersion", t, func() {
+		Convey("should use the fallback when kubectl does not send exec info", func() {
+			version, err := execCredentialAPIVersion("", execCredentialV1beta1)
+			So(err, ShouldEqual, nil)
+			So(version, ShouldEqual, execCredentialV1beta1)
+		})
+		Convey("should prefer the apiVersion kubectl sends", func() {
+			version, err := execCredentialAPIVersion(`{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","spec":{"interactive":true}}`, execCredentialV1beta1)
+			So(err, ShouldEqual, nil)
+			So(version, ShouldEqual, execCredentialV1)
+		})
+		Convey("should return an error for an unsupported apiVersion", func() {
+			_, err := execCredentialAPIVersion(`{"apiVersion":"client.authentication.k8s.io/v1alpha1"}`, execCredentialV1beta1)
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("should return an error if the exec info is not JSON", func() {
+			_, err := execCredentialAPIVersion("hoopla", execCredentialV1beta1)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestNewExecCredential(t *testing.T) {
+	Convey("newExecCredential", t, func() {
+		expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+		Convey("should carry the token and an RFC 3339 expiration timestamp", func() {
+			cred := newExecCredential(execCredentialV1, "hoopla", expiry)
+			So(cred.Kind, ShouldEqual, execCredentialKind)
+			So(cred.APIVersion, ShouldEqual, execCredentialV1)
+			So(cred.Status.Token, ShouldEqual, "hoopla")
+			So(cred.Status.ExpirationTimestamp, ShouldEqual, "2030-01-02T03:04:05Z")
+		})
+		Convey("should leave out the expiration timestamp if it is unknown", func() {
+			cred := newExecCredential(execCredentialV1, "hoopla", time.Time{})
+			So(cred.Status.ExpirationTimestamp, ShouldEqual, "")
+		})
+	})
+}
+
+func TestGetToken(t *testing.T) {
+	Convey("getToken", t, func() {
+		var app app
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		app.tokenCacheDir = dir
+		app.kubeloginServer = "https://kubelogin.example.com"
+		app.kubectlUser = "test"
+		Convey("should print the cached token without logging in if it is still fresh", func() {
+			expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+			jwt := fakeJWT(map[string]interface{}{"exp": expiry.Unix()})
+			So(app.writeTokenCache(jwt), ShouldEqual, nil)
+			var out bytes.Buffer
+			So(app.getToken(&out, execCredentialV1), ShouldEqual, nil)
+			var cred execCredential
+			So(json.Unmarshal(out.Bytes(), &cred), ShouldEqual, nil)
+			So(cred.Status.Token, ShouldEqual, jwt)
+			So(cred.Status.ExpirationTimestamp, ShouldEqual, expiry.UTC().Format(time.RFC3339))
+		})
+		Convey("should not treat an expired cached token as fresh", func() {
+			jwt := fakeJWT(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})
+			So(app.writeTokenCache(jwt), ShouldEqual, nil)
+			cached, _ := app.freshCachedToken(0)
+			So(cached, ShouldEqual, "")
+		})
+		Convey("should not treat a cached token about to expire as fresh", func() {
+			jwt := fakeJWT(map[string]interface{}{"exp": time.Now().Add(30 * time.Second).Unix()})
+			So(app.writeTokenCache(jwt), ShouldEqual, nil)
+			cached, _ := app.freshCachedToken(cachedTokenMargin)
+			So(cached, ShouldEqual, "")
+			cached, _ = app.freshCachedToken(0)
+			So(cached, ShouldEqual, jwt)
+		})
+		Convey("should keep separate cache entries per server", func() {
+			other := app
+			other.kubeloginServer = "https://other.example.com"
+			So(other.tokenCachePath(), ShouldNotEqual, app.tokenCachePath())
+		})
+		Convey("should keep separate cache entries per provider", func() {
+			other := app
+			other.provider = "partners"
+			So(other.tokenCachePath(), ShouldNotEqual, app.tokenCachePath())
+		})
+	})
+}
+
+func TestParseJWTExpiry(t *testing.T) {
+	Convey("parseJWTExpiry", t, func() {
+		Convey("should return the exp claim as a time", func() {
+			expiry, err := parseJWTExpiry(fakeJWT(map[string]interface{}{"exp": 1893456000}))
+			So(err, ShouldEqual, nil)
+			So(expiry.Unix(), ShouldEqual, 1893456000)
+		})
+		Convey("should return an error if the token is not a JWT", func() {
+			_, err := parseJWTExpiry("hoopla")
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("should return an error if exp is missing", func() {
+			_, err := parseJWTExpiry(fakeJWT(map[string]interface{}{"sub": "hoopla"}))
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// kubeYAML is only used to read the kube config. Writes go through the document node instead so fields
+// that aren't modelled here survive.
+type kubeYAML struct {
+	APIVersion string `yaml:"apiVersion"`
+	Clusters   []struct {
+		Cluster map[string]interface{} `yaml:"cluster"`
+		Name    string                 `yaml:"name"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Context map[string]interface{} `yaml:"context"`
+		Name    string                 `yaml:"name"`
+	} `yaml:"contexts"`
+	CurrentContext string                 `yaml:"current-context"`
+	Kind           string                 `yaml:"kind"`
+	Preferences    map[string]interface{} `yaml:"preferences"`
+	Users          []k8User               `yaml:"users"`
+}
+
+type k8User struct {
+	Name string                 `yaml:"name"`
+	User map[string]interface{} `yaml:"user"`
+}
+
+// Parses a kube config into a document node, keeping comments, key order and keys kubelogin doesn't know.
+// An empty file gives an empty document.
+func parseKubeconfig(contents []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(contents, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		doc.Kind = yaml.DocumentNode
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("kube config is not a mapping")
+	}
+	return &doc, nil
+}
+
+// Writes the document back out. yaml.v3 always indents lists under a key, so files that don't, like the
+// ones kubectl writes, have their lists moved back out to keep the diff down to what kubelogin changed.
+func marshalKubeconfig(doc *yaml.Node) ([]byte, error) {
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	if !compactSequences(doc) {
+		return out.Bytes(), nil
+	}
+	return outdentSequences(out.Bytes())
+}
+
+// whether the first list under a key was parsed at the key's own indentation. Documents without
+// one are written the way kubectl does.
+func compactSequences(node *yaml.Node) bool {
+	compact, found := findSequenceStyle(node)
+	return compact || !found
+}
+
+func findSequenceStyle(node *yaml.Node) (compact bool, found bool) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if value.Kind == yaml.SequenceNode && value.Style&yaml.FlowStyle == 0 && value.Line > 0 && len(value.Content) > 0 {
+				return value.Column == key.Column, true
+			}
+		}
+	}
+	for _, child := range node.Content {
+		if compact, found := findSequenceStyle(child); found {
+			return compact, true
+		}
+	}
+	return false, false
+}
+
+// Moves every list under a key, with everything in it, back by the two spaces yaml.v3 indents it by. The
+// encoded document is parsed again to find the lines of each list.
+func outdentSequences(encoded []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(encoded, &doc); err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(encoded), "\n")
+	shifts := make([]int, len(lines))
+	markSequenceShifts(&doc, lines, shifts, len(lines))
+	for i, line := range lines {
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if shifts[i] > indent {
+			shifts[i] = indent
+		}
+		lines[i] = line[shifts[i]:]
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// adds the shift of each list under a key to its lines, which run up to where its next sibling starts.
+// Lines indented less than the list, like comments of the next key, stay where they are.
+func markSequenceShifts(node *yaml.Node, lines []string, shifts []int, end int) {
+	for i, child := range node.Content {
+		// a value ends where the next key starts, a list item where the next item does
+		childEnd := end
+		if i+1 < len(node.Content) {
+			childEnd = node.Content[i+1].Line - 1
+		}
+		if node.Kind == yaml.MappingNode && i%2 == 1 && child.Kind == yaml.SequenceNode && child.Style&yaml.FlowStyle == 0 && len(child.Content) > 0 {
+			for line := child.Line - 1; line < childEnd && line < len(lines); line++ {
+				if len(lines[line])-len(strings.TrimLeft(lines[line], " ")) >= child.Column-1 {
+					shifts[line] += 2
+				}
+			}
+		}
+		markSequenceShifts(child, lines, shifts, childEnd)
+	}
+}
+
+// returns the value stored under key in a mapping node, or nil if there is none
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func deleteMappingKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// replaces the value stored under key in a mapping node, adding the key at the end if it's missing. Comments
+// on the old value are kept.
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			old := mapping.Content[i+1]
+			value.HeadComment, value.LineComment, value.FootComment = old.HeadComment, old.LineComment, old.FootComment
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// returns the mapping stored under key, creating it if it's missing or null
+func childMapping(mapping *yaml.Node, key string) (*yaml.Node, error) {
+	child := mappingValue(mapping, key)
+	if child == nil || child.Tag == "!!null" {
+		child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		setMappingValue(mapping, key, child)
+	}
+	if child.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s is not a mapping", key)
+	}
+	return child, nil
+}
+
+func stringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// Pure function to test adding/editing token to kubectl config. Only the token of the user is touched.
+// An empty token removes it, leaving the rest of the user alone.
+func editToken(doc *yaml.Node, username string, t string) error {
+	if t == "" && !hasNamedEntry("users", username)(doc) {
+		return nil
+	}
+	users, err := namedEntries(doc, "users", username)
+	if err != nil {
+		return err
+	}
+	for _, entry := range users {
+		// We only care about a token entry, bypass the issues with client certs
+		user, err := childMapping(entry, "user")
+		if err != nil {
+			return errors.Wrapf(err, "user %s", username)
+		}
+		if t == "" {
+			deleteMappingKey(user, "token")
+			continue
+		}
+		setMappingValue(user, "token", stringNode(t))
+	}
+	return nil
+}
+
+// Returns the entries of a kube config list (users, clusters or contexts) with the given name, adding one
+// at the end of the list if there are none.
+func namedEntries(doc *yaml.Node, listKey, name string) ([]*yaml.Node, error) {
+	root := doc.Content[0]
+	list := mappingValue(root, listKey)
+	if list == nil || list.Tag == "!!null" {
+		list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		setMappingValue(root, listKey, list)
+	}
+	if list.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s is not a list", listKey)
+	}
+	var entries []*yaml.Node
+	for _, entry := range list.Content {
+		if entry.Kind != yaml.MappingNode {
+			continue
+		}
+		if entryName := mappingValue(entry, "name"); entryName != nil && entryName.Value == name {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		entry := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		setMappingValue(entry, "name", stringNode(name))
+		list.Content = append(list.Content, entry)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Points the cluster at the alias's API server and CA, keeping any other settings it has.
+func editCluster(doc *yaml.Node, kc KubectlContext) error {
+	clusters, err := namedEntries(doc, "clusters", kc.Cluster)
+	if err != nil {
+		return err
+	}
+	for _, entry := range clusters {
+		cluster, err := childMapping(entry, "cluster")
+		if err != nil {
+			return errors.Wrapf(err, "cluster %s", kc.Cluster)
+		}
+		if kc.Server != "" {
+			setMappingValue(cluster, "server", stringNode(kc.Server))
+		}
+		if kc.CertificateAuthorityData != "" {
+			// kubectl complains when a cluster has both
+			deleteMappingKey(cluster, "certificate-authority")
+			setMappingValue(cluster, "certificate-authority-data", stringNode(kc.CertificateAuthorityData))
+		}
+	}
+	return nil
+}
+
+// Ties the context to the alias's cluster, user and namespace.
+func editContext(doc *yaml.Node, kc KubectlContext, username string) error {
+	name := kc.contextName()
+	contexts, err := namedEntries(doc, "contexts", name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range contexts {
+		context, err := childMapping(entry, "context")
+		if err != nil {
+			return errors.Wrapf(err, "context %s", name)
+		}
+		if kc.Cluster != "" {
+			setMappingValue(context, "cluster", stringNode(kc.Cluster))
+		}
+		setMappingValue(context, "user", stringNode(username))
+		if kc.Namespace != "" {
+			setMappingValue(context, "namespace", stringNode(kc.Namespace))
+		}
+	}
+	return nil
+}
+
+// kubectl reads a list of kube config files from KUBECONFIG, separated like PATH
+const kubeconfigEnv = "KUBECONFIG"
+
+// Splits KUBECONFIG the way kubectl does, dropping empty and repeated entries. Without any files in it,
+// the default path is used.
+func kubeconfigPathsFromEnv(envList, defaultPath string) []string {
+	var paths []string
+	seen := map[string]bool{}
+	for _, path := range filepath.SplitList(envList) {
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return []string{defaultPath}
+	}
+	return paths
+}
+
+// --kubeconfig beats the alias's kubeconfig setting, which beats KUBECONFIG
+func (app *app) setKubeconfigPaths(flagPath, envList, defaultPath string) {
+	if flagPath != "" {
+		app.kubectlConfigPaths = []string{flagPath}
+	} else if len(app.kubectlConfigPaths) == 0 {
+		app.kubectlConfigPaths = kubeconfigPathsFromEnv(envList, defaultPath)
+	}
+}
+
+// kubeconfigFile is one file of the kube config list; doc is empty if the file doesn't exist yet
+type kubeconfigFile struct {
+	path   string
+	doc    *yaml.Node
+	mode   os.FileMode
+	exists bool
+}
+
+// Reads every file in the kube config list. Files that don't exist are skipped by kubectl, so they are
+// returned empty rather than failing.
+func (app *app) loadKubeconfigs() ([]*kubeconfigFile, error) {
+	var files []*kubeconfigFile
+	for _, path := range app.kubectlConfigPaths {
+		file, err := loadKubeconfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func loadKubeconfigFile(path string) (*kubeconfigFile, error) {
+	file := &kubeconfigFile{path: path, mode: 0600}
+	contents, err := ioutil.ReadFile(path)
+	if err == nil {
+		file.exists = true
+		// Avoid guessing at appropriate file mode later
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not stat kube config %s: %v", path, err)
+		}
+		file.mode = fi.Mode()
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read kube config file: %v", err)
+	}
+	if file.doc, err = parseKubeconfig(contents); err != nil {
+		return nil, fmt.Errorf("could not unmarshal kube config %s: %v", path, err)
+	}
+	return file, nil
+}
+
+// Picks the file kubectl would take a user, cluster, context or the current-context from: the first one that
+// defines it. Anything new goes into the first file that exists, or the first file of the list if none do.
+func kubeconfigFileFor(files []*kubeconfigFile, defines func(doc *yaml.Node) bool) *kubeconfigFile {
+	for _, file := range files {
+		if defines(file.doc) {
+			return file
+		}
+	}
+	for _, file := range files {
+		if file.exists {
+			return file
+		}
+	}
+	return files[0]
+}
+
+func hasNamedEntry(listKey, name string) func(doc *yaml.Node) bool {
+	return func(doc *yaml.Node) bool {
+		list := mappingValue(doc.Content[0], listKey)
+		if list == nil || list.Kind != yaml.SequenceNode {
+			return false
+		}
+		for _, entry := range list.Content {
+			if entry.Kind != yaml.MappingNode {
+				continue
+			}
+			if entryName := mappingValue(entry, "name"); entryName != nil && entryName.Value == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func hasCurrentContext(doc *yaml.Node) bool {
+	currentContext := mappingValue(doc.Content[0], "current-context")
+	return currentContext != nil && currentContext.Value != ""
+}
+
+// Merges the kube config files pointed to by the app like kubectl does: the first file to define a
+// cluster, context or user wins, as does the first current-context that is set.
+func (app *app) readKubectl() (*kubeYAML, error) {
+	files, err := app.loadKubeconfigs()
+	if err != nil {
+		return nil, err
+	}
+	var merged kubeYAML
+	clusters, contexts, users := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	found := false
+	for _, file := range files {
+		if !file.exists {
+			continue
+		}
+		found = true
+		var ky kubeYAML
+		if err := file.doc.Decode(&ky); err != nil {
+			return nil, fmt.Errorf("could not unmarshal kube config %s: %v", file.path, err)
+		}
+		if merged.APIVersion == "" {
+			merged.APIVersion, merged.Kind, merged.Preferences = ky.APIVersion, ky.Kind, ky.Preferences
+		}
+		if merged.CurrentContext == "" {
+			merged.CurrentContext = ky.CurrentContext
+		}
+		for _, cluster := range ky.Clusters {
+			if !clusters[cluster.Name] {
+				clusters[cluster.Name] = true
+				merged.Clusters = append(merged.Clusters, cluster)
+			}
+		}
+		for _, context := range ky.Contexts {
+			if !contexts[context.Name] {
+				contexts[context.Name] = true
+				merged.Contexts = append(merged.Contexts, context)
+			}
+		}
+		for _, user := range ky.Users {
+			if !users[user.Name] {
+				users[user.Name] = true
+				merged.Users = append(merged.Users, user)
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("could not read kube config file: none of %s exist", strings.Join(app.kubectlConfigPaths, ", "))
+	}
+	return &merged, nil
+}
+
+// Sets the token in the kube config file that owns the user, and sets up the alias's cluster and context.
+// Files that own none of these are left alone.
+func (app *app) configureKubectl(jwt string) error {
+	files, err := app.loadKubeconfigs()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no kube config file to write the token to")
+	}
+	// each edit goes to the file kubectl would read that entry from, so several files may change
+	var paths []string
+	edits := map[string][]func(doc *yaml.Node) error{}
+	addEdit := func(file *kubeconfigFile, edit func(doc *yaml.Node) error) {
+		if _, ok := edits[file.path]; !ok {
+			paths = append(paths, file.path)
+		}
+		edits[file.path] = append(edits[file.path], edit)
+	}
+
+	// Edit or add user in pure function (for testing purposes)
+	addEdit(kubeconfigFileFor(files, hasNamedEntry("users", app.kubectlUser)), func(doc *yaml.Node) error {
+		return editToken(doc, app.kubectlUser, jwt)
+	})
+	kc := app.kubectlContext
+	if kc.Cluster != "" && (kc.Server != "" || kc.CertificateAuthorityData != "") {
+		addEdit(kubeconfigFileFor(files, hasNamedEntry("clusters", kc.Cluster)), func(doc *yaml.Node) error {
+			return editCluster(doc, kc)
+		})
+	}
+	if name := kc.contextName(); name != "" {
+		addEdit(kubeconfigFileFor(files, hasNamedEntry("contexts", name)), func(doc *yaml.Node) error {
+			return editContext(doc, kc, app.kubectlUser)
+		})
+		if kc.SetCurrentContext {
+			addEdit(kubeconfigFileFor(files, hasCurrentContext), func(doc *yaml.Node) error {
+				setMappingValue(doc.Content[0], "current-context", stringNode(name))
+				return nil
+			})
+		}
+	}
+
+	for _, path := range paths {
+		if err := editKubeconfigFile(path, edits[path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the user's token from the kube config file kubectl reads the user from, returning that file,
+// or an empty string if there was no token.
+func (app *app) removeKubeconfigToken() (string, error) {
+	// no kube config, no such user or no token all leave nothing to remove
+	if _, err := app.kubeconfigToken(); err != nil {
+		return "", nil
+	}
+	files, err := app.loadKubeconfigs()
+	if err != nil {
+		return "", err
+	}
+	file := kubeconfigFileFor(files, hasNamedEntry("users", app.kubectlUser))
+	err = editKubeconfigFile(file.path, []func(doc *yaml.Node) error{func(doc *yaml.Node) error {
+		return editToken(doc, app.kubectlUser, "")
+	}})
+	if err != nil {
+		return "", err
+	}
+	return file.path, nil
+}
+
+// Applies the edits to one kube config file while holding its lock.
+func editKubeconfigFile(path string, edits []func(doc *yaml.Node) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("could not create kube config directory: %v", err)
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// kubectl may have changed the file before the lock was taken
+	file, err := loadKubeconfigFile(path)
+	if err != nil {
+		return err
+	}
+	for _, edit := range edits {
+		if err := edit(file.doc); err != nil {
+			return fmt.Errorf("could not edit kube config %s: %v", path, err)
+		}
+	}
+
+	out, err := marshalKubeconfig(file.doc)
+	if err != nil {
+		return fmt.Errorf("could not write kube config: %v", err)
+	}
+	if err := writeFileAtomic(file.path, out, file.mode); err != nil {
+		return fmt.Errorf("could not write kube config %s: %v", file.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKubeconfigPathsFromEnv(t *testing.T) {
+	Convey("kubeconfigPathsFromEnv", t, func() {
+		separator := string(filepath.ListSeparator)
+		Convey("should keep the order of KUBECONFIG and drop empty and repeated entries", func() {
+			envList := strings.Join([]string{"/a", "", "/b", "/a"}, separator)
+			So(kubeconfigPathsFromEnv(envList, "/default"), ShouldResemble, []string{"/a", "/b"})
+		})
+		Convey("should fall back to the default path", func() {
+			So(kubeconfigPathsFromEnv("", "/default"), ShouldResemble, []string{"/default"})
+			So(kubeconfigPathsFromEnv(separator, "/default"), ShouldResemble, []string{"/default"})
+		})
+	})
+}
+
+func TestKubeconfigList(t *testing.T) {
+	Convey("with several kube config files", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		first := filepath.Join(dir, "first")
+		second := filepath.Join(dir, "second")
+		var app app
+		app.kubectlConfigPaths = []string{filepath.Join(dir, "missing"), first, second}
+		So(ioutil.WriteFile(first, []byte("current-context: first\nusers:\n- name: shared\n  user:\n    token: firstToken\n"), 0600), ShouldEqual, nil)
+		So(ioutil.WriteFile(second, []byte("current-context: second\nusers:\n- name: shared\n  user:\n    token: secondToken\n- name: owned\n  user:\n    token: ownedToken\n"), 0644), ShouldEqual, nil)
+		read := func(path string) string {
+			contents, err := ioutil.ReadFile(path)
+			So(err, ShouldEqual, nil)
+			return string(contents)
+		}
+
+		Convey("readKubectl should let the first file to define something win", func() {
+			ky, err := app.readKubectl()
+			So(err, ShouldEqual, nil)
+			So(ky.CurrentContext, ShouldEqual, "first")
+			So(len(ky.Users), ShouldEqual, 2)
+			ok, u := findUserInList(ky.Users, "shared")
+			So(ok, ShouldBeTrue)
+			So(u.User["token"], ShouldEqual, "firstToken")
+		})
+		Convey("configureKubectl should only write to the file that owns the user", func() {
+			app.kubectlUser = "owned"
+			So(app.configureKubectl("hoopla"), ShouldEqual, nil)
+			So(read(first), ShouldNotContainSubstring, "hoopla")
+			So(read(second), ShouldContainSubstring, "token: hoopla")
+			fi, err := os.Stat(second)
+			So(err, ShouldEqual, nil)
+			So(fi.Mode().Perm(), ShouldEqual, os.FileMode(0644))
+		})
+		Convey("configureKubectl should update the user kubectl would use when more than one file has it", func() {
+			app.kubectlUser = "shared"
+			So(app.configureKubectl("hoopla"), ShouldEqual, nil)
+			So(read(first), ShouldContainSubstring, "token: hoopla")
+			So(read(second), ShouldContainSubstring, "token: secondToken")
+		})
+		Convey("configureKubectl should add a new user to the first file that exists", func() {
+			app.kubectlUser = "new"
+			So(app.configureKubectl("hoopla"), ShouldEqual, nil)
+			So(read(first), ShouldContainSubstring, "name: new")
+			So(read(second), ShouldNotContainSubstring, "name: new")
+			_, err := os.Stat(filepath.Join(dir, "missing"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+		Convey("configureKubectl should create the first file when none exist", func() {
+			app.kubectlConfigPaths = []string{filepath.Join(dir, "new", "config")}
+			app.kubectlUser = "new"
+			So(app.configureKubectl("hoopla"), ShouldEqual, nil)
+			So(read(app.kubectlConfigPaths[0]), ShouldContainSubstring, "token: hoopla")
+		})
+		Convey("readKubectl should fail when none of the files exist", func() {
+			app.kubectlConfigPaths = []string{filepath.Join(dir, "missing")}
+			_, err := app.readKubectl()
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func findUserInList(users []k8User, name string) (bool, k8User) {
+	for _, u := range users {
+		if u.Name == name {
+			return true, u
+		}
+	}
+	return false, k8User{}
+}
+
+func TestConfigureKubectlContext(t *testing.T) {
+	Convey("configureKubectl with a cluster and context", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		path := filepath.Join(dir, "config")
+		var app app
+		app.kubectlConfigPaths = []string{path}
+		app.kubectlUser = "example_oidc"
+		app.kubectlContext = KubectlContext{
+			Cluster:                  "example",
+			Server:                   "https://kubernetes.example.com",
+			CertificateAuthorityData: "Y2E=",
+			Namespace:                "team",
+			SetCurrentContext:        true,
+		}
+		read := func() kubeYAML {
+			ky, err := app.readKubectl()
+			So(err, ShouldEqual, nil)
+			return *ky
+		}
+
+		Convey("should create the cluster, context and current-context in an empty file", func() {
+			So(app.configureKubectl("hoopla"), ShouldEqual, nil)
+			ky := read()
+			So(ky.CurrentContext, ShouldEqual, "example")
+			So(len(ky.Clusters), ShouldEqual, 1)
+			So(ky.Clusters[0].Name, ShouldEqual, "example")
+			So(ky.Clusters[0].Cluster["server"], ShouldEqual, "https://kubernetes.example.com")
+			So(ky.Clusters[0].Cluster["certificate-authority-data"], ShouldEqual, "Y2E=")
+			So(len(ky.Contexts), ShouldEqual, 1)
+			So(ky.Contexts[0].Name, ShouldEqual, "example")
+			So(ky.Contexts[0].Context, ShouldResemble, map[string]interface{}{"cluster": "example", "user": "example_oidc", "namespace": "team"})
+		})
+		Convey("should update existing entries and keep their other settings", func() {
+			So(ioutil.WriteFile(path, []byte(`clusters:
+- name: example
+  cluster:
+    server: https://old.example.com
+    certificate-authority: ca.pem
+    insecure-skip-tls-verify: false
+contexts:
+- name: prod
+  context:
+    cluster: other
+    user: someone
+    namespace: old
+current-context: other
+`), 0600), ShouldEqual, nil)
+			app.kubectlContext.Context = "prod"
+			app.kubectlContext.Namespace = ""
+			app.kubectlContext.SetCurrentContext = false
+			So(app.configureKubectl("hoopla"), ShouldEqual, nil)
+			ky := read()
+			So(ky.CurrentContext, ShouldEqual, "other")
+			So(ky.Clusters[0].Cluster, ShouldResemble, map[string]interface{}{
+				"server":                     "https://kubernetes.example.com",
+				"insecure-skip-tls-verify":   false,
+				"certificate-authority-data": "Y2E=",
+			})
+			So(ky.Contexts[0].Context, ShouldResemble, map[string]interface{}{"cluster": "example", "user": "example_oidc", "namespace": "old"})
+		})
+		Convey("should write each entry to the file kubectl reads it from", func() {
+			second := filepath.Join(dir, "second")
+			app.kubectlConfigPaths = []string{path, second}
+			So(ioutil.WriteFile(path, []byte("users:\n- name: example_oidc\n  user: {}\n"), 0600), ShouldEqual, nil)
+			So(ioutil.WriteFile(second, []byte("contexts:\n- name: example\n  context: {}\ncurrent-context: other\n"), 0600), ShouldEqual, nil)
+			So(app.configureKubectl("hoopla"), ShouldEqual, nil)
+			first, _ := ioutil.ReadFile(path)
+			So(string(first), ShouldContainSubstring, "token: hoopla")
+			So(string(first), ShouldContainSubstring, "name: example")
+			So(string(first), ShouldNotContainSubstring, "contexts")
+			So(string(first), ShouldNotContainSubstring, "current-context")
+			contents, _ := ioutil.ReadFile(second)
+			So(string(contents), ShouldContainSubstring, "user: example_oidc")
+			So(string(contents), ShouldContainSubstring, "current-context: example")
+		})
+	})
+}
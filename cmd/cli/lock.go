@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// kubectl guards its config files with a <file>.lock created exclusively, so holding the same lock keeps
+// kubelogin and kubectl from overwriting each other's changes
+const (
+	lockFileSuffix = ".lock"
+	lockAttempts   = 50
+	lockRetryDelay = 100 * time.Millisecond
+)
+
+// swapped out in tests so waiting for a lock doesn't take real time
+var lockSleep = time.Sleep
+
+var errFileLocked = errors.New("file is locked by another process")
+
+// Takes the lock for path, retrying for a few seconds while another process holds it. The returned
+// function releases it.
+func lockFile(path string) (func(), error) {
+	lockPath := path + lockFileSuffix
+	for attempt := 1; ; attempt++ {
+		lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL, 0)
+		if err == nil {
+			lock.Close() // nolint: errcheck
+			return func() {
+				os.Remove(lockPath) // nolint: errcheck
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, errors.Wrapf(err, "failed to lock %s", path)
+		}
+		if attempt == lockAttempts {
+			return nil, errors.Wrapf(errFileLocked, "gave up waiting for %s; if nothing else is using it, remove %s", path, lockPath)
+		}
+		lockSleep(lockRetryDelay)
+	}
+}
+
+// Writes to a temporary file next to path and renames it into place, so readers see either the old
+// contents or the new ones and never a partial write. A symlink is followed so the link itself survives.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	// only does anything if the rename didn't happen
+	defer os.Remove(tmp.Name()) // nolint: errcheck
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close() // nolint: errcheck
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close() // nolint: errcheck
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close() // nolint: errcheck
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// makes the rename itself durable; not every platform can sync a directory, so failures are ignored
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()  // nolint: errcheck
+		dir.Close() // nolint: errcheck
+	}
+	return nil
+}
+
+// writeFileAtomic under the file's lock
+func writeFileLocked(path string, data []byte, mode os.FileMode) error {
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := writeFileAtomic(path, data, mode); err != nil {
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLockFile(t *testing.T) {
+	Convey("lockFile", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		var slept int
+		lockSleep = func(time.Duration) { slept++ }
+		defer func() { lockSleep = time.Sleep }()
+		path := filepath.Join(dir, "config")
+
+		Convey("should create the lock file and remove it on unlock", func() {
+			unlock, err := lockFile(path)
+			So(err, ShouldEqual, nil)
+			_, err = os.Stat(path + lockFileSuffix)
+			So(err, ShouldEqual, nil)
+			unlock()
+			_, err = os.Stat(path + lockFileSuffix)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+		Convey("should retry and then give up while someone else holds the lock", func() {
+			So(ioutil.WriteFile(path+lockFileSuffix, nil, 0600), ShouldEqual, nil)
+			_, err := lockFile(path)
+			So(errors.Cause(err), ShouldEqual, errFileLocked)
+			So(err.Error(), ShouldContainSubstring, path+lockFileSuffix)
+			So(slept, ShouldEqual, lockAttempts-1)
+		})
+		Convey("should get the lock once the other holder lets go", func() {
+			So(ioutil.WriteFile(path+lockFileSuffix, nil, 0600), ShouldEqual, nil)
+			lockSleep = func(time.Duration) { os.Remove(path + lockFileSuffix) } // nolint: errcheck
+			unlock, err := lockFile(path)
+			So(err, ShouldEqual, nil)
+			unlock()
+		})
+		Convey("writeFileLocked should fail without touching a locked file", func() {
+			So(ioutil.WriteFile(path, []byte("old"), 0600), ShouldEqual, nil)
+			So(ioutil.WriteFile(path+lockFileSuffix, nil, 0600), ShouldEqual, nil)
+			So(errors.Cause(writeFileLocked(path, []byte("new"), 0600)), ShouldEqual, errFileLocked)
+			contents, _ := ioutil.ReadFile(path)
+			So(string(contents), ShouldEqual, "old")
+		})
+	})
+}
+
+func TestEditConfigFile(t *testing.T) {
+	Convey("editConfigFile", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		lockSleep = func(time.Duration) { time.Sleep(time.Millisecond) }
+		defer func() { lockSleep = time.Sleep }()
+		path := filepath.Join(dir, ".kubeloginrc.yaml")
+
+		Convey("should create a missing file", func() {
+			So(editConfigFile(path, func(config *Config) error {
+				config.appendAlias(AliasConfig{Alias: "test"})
+				return nil
+			}), ShouldEqual, nil)
+			config, err := readConfigFile(path)
+			So(err, ShouldEqual, nil)
+			So(len(config.Aliases), ShouldEqual, 1)
+		})
+		Convey("should not lose either of two concurrent updates", func() {
+			var config Config
+			config.appendAlias(AliasConfig{Alias: "one"})
+			config.appendAlias(AliasConfig{Alias: "two"})
+			So(config.writeToFile(path), ShouldEqual, nil)
+			editing := make(chan struct{})
+			done := make(chan error)
+			go func() {
+				done <- editConfigFile(path, func(config *Config) error {
+					close(editing)
+					// gives the other update time to read the file if the lock didn't stop it
+					time.Sleep(50 * time.Millisecond)
+					aliasConfig, _ := config.aliasSearch("one")
+					aliasConfig.RefreshToken = "first"
+					return nil
+				})
+			}()
+			<-editing
+			So(editConfigFile(path, func(config *Config) error {
+				aliasConfig, _ := config.aliasSearch("two")
+				aliasConfig.RefreshToken = "second"
+				return nil
+			}), ShouldEqual, nil)
+			So(<-done, ShouldEqual, nil)
+			written, err := readConfigFile(path)
+			So(err, ShouldEqual, nil)
+			one, _ := written.aliasSearch("one")
+			two, _ := written.aliasSearch("two")
+			So(one.RefreshToken, ShouldEqual, "first")
+			So(two.RefreshToken, ShouldEqual, "second")
+		})
+		Convey("should leave the file alone when the edit fails", func() {
+			So(ioutil.WriteFile(path, []byte("aliases: []\n"), 0600), ShouldEqual, nil)
+			So(editConfigFile(path, func(config *Config) error {
+				config.appendAlias(AliasConfig{Alias: "test"})
+				return errors.New("hoopla")
+			}), ShouldNotEqual, nil)
+			contents, _ := ioutil.ReadFile(path)
+			So(string(contents), ShouldEqual, "aliases: []\n")
+		})
+	})
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	Convey("writeFileAtomic", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		path := filepath.Join(dir, "config")
+
+		Convey("should replace the file with the given mode and leave no temporary files", func() {
+			So(ioutil.WriteFile(path, []byte("old"), 0600), ShouldEqual, nil)
+			So(writeFileAtomic(path, []byte("new"), 0640), ShouldEqual, nil)
+			contents, _ := ioutil.ReadFile(path)
+			So(string(contents), ShouldEqual, "new")
+			fi, err := os.Stat(path)
+			So(err, ShouldEqual, nil)
+			So(fi.Mode().Perm(), ShouldEqual, os.FileMode(0640))
+			entries, _ := ioutil.ReadDir(dir)
+			So(len(entries), ShouldEqual, 1)
+		})
+		Convey("should write through a symlink instead of replacing it", func() {
+			target := filepath.Join(dir, "target")
+			So(ioutil.WriteFile(target, []byte("old"), 0600), ShouldEqual, nil)
+			if err := os.Symlink(target, path); err != nil {
+				t.Skip("symlinks not supported:", err)
+			}
+			So(writeFileAtomic(path, []byte("new"), 0600), ShouldEqual, nil)
+			fi, err := os.Lstat(path)
+			So(err, ShouldEqual, nil)
+			So(fi.Mode()&os.ModeSymlink, ShouldNotEqual, 0)
+			contents, _ := ioutil.ReadFile(target)
+			So(string(contents), ShouldEqual, "new")
+		})
+	})
+}
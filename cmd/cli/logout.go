@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// logoutResponse is the kubelogin server's answer to /logout
+type logoutResponse struct {
+	Revoked       bool   `json:"revoked"`
+	EndSessionURL string `json:"end_session_url"`
+}
+
+// Asks the kubelogin server to revoke the refresh token at the provider. The JWT goes along as the
+// id_token_hint of the provider's end session URL, which comes back if the provider has one.
+func (app *app) revokeAtServer(jwt string) (*logoutResponse, error) {
+	form := url.Values{}
+	form.Set("refresh_token", app.refreshToken)
+	form.Set("id_token", jwt)
+	if app.provider != "" {
+		form.Set(providerField, app.provider)
+	}
+	req, err := http.NewRequest("POST", app.kubeloginServer+"/logout", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubelogin server returned %s", res.Status)
+	}
+	var logout logoutResponse
+	if err := json.NewDecoder(res.Body).Decode(&logout); err != nil {
+		return nil, errors.Wrap(err, "failed to decode kubelogin server response")
+	}
+	return &logout, nil
+}
+
+// Returns false if get-token had no token cached for the user.
+func (app *app) removeTokenCache() (bool, error) {
+	err := os.Remove(app.tokenCachePath())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to remove token cache")
+	}
+	return true, nil
+}
+
+func (app *app) removeRefreshToken() error {
+	err := editConfigFile(app.filenameWithPath, func(config *Config) error {
+		aliasConfig, ok := config.aliasSearch(app.kubeloginAlias)
+		if !ok {
+			return fmt.Errorf("could not find the alias '%s' to remove the refresh token", app.kubeloginAlias)
+		}
+		aliasConfig.RefreshToken = ""
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	app.refreshToken = ""
+	return nil
+}
+
+// Logs out of the alias or one time login the app is set up for, and returns a line for each thing that
+// was cleared. When asked to revoke, the server is called first since it needs the tokens; the local
+// credentials are removed even if that fails, and the failure is returned afterwards. Without a refresh
+// token there is nothing to revoke, so the server isn't called.
+func (app *app) logout(revoke bool) ([]string, error) {
+	name := app.kubectlUser
+	if app.kubeloginAlias != "" {
+		name = app.kubeloginAlias
+	}
+	var report []string
+	var revokeErr error
+	if revoke && app.refreshToken != "" {
+		jwt, err := app.kubeconfigToken()
+		if err != nil {
+			jwt, _ = app.readTokenCache()
+		}
+		logout, err := app.revokeAtServer(jwt)
+		switch {
+		case err != nil:
+			revokeErr = errors.Wrapf(err, "failed to revoke the refresh token of %s", name)
+		case logout.Revoked:
+			report = append(report, fmt.Sprintf("Revoked the refresh token of %s at the identity provider", name))
+		}
+		if logout != nil && logout.EndSessionURL != "" {
+			report = append(report, fmt.Sprintf("Open %s to end the identity provider session of %s", logout.EndSessionURL, name))
+		}
+	}
+
+	path, err := app.removeKubeconfigToken()
+	if err != nil {
+		return report, err
+	}
+	if path != "" {
+		report = append(report, fmt.Sprintf("Removed the token of kubectl user %s from %s", app.kubectlUser, path))
+	}
+	cached, err := app.removeTokenCache()
+	if err != nil {
+		return report, err
+	}
+	if cached {
+		report = append(report, fmt.Sprintf("Removed the cached token of %s", name))
+	}
+	if app.refreshToken != "" && app.kubeloginAlias != "" {
+		if err := app.removeRefreshToken(); err != nil {
+			return report, err
+		}
+		report = append(report, fmt.Sprintf("Removed the refresh token of alias %s", name))
+	}
+	if len(report) == 0 {
+		report = append(report, fmt.Sprintf("Nothing to clear for %s", name))
+	}
+	return report, revokeErr
+}
+
+// Logs out of each of the named aliases, or of every alias with all, each with its own kube config
+// settings as login would use. Every alias is logged out of even if one fails; the first error is returned.
+func (app *app) logoutAliases(aliases []string, all, revoke bool, kubeconfigFlag, envList, defaultKubeconfigPath string, out io.Writer) error {
+	if all {
+		config, err := readConfigFile(app.filenameWithPath)
+		if err != nil {
+			return err
+		}
+		aliases = nil
+		for _, aliasConfig := range config.Aliases {
+			aliases = append(aliases, aliasConfig.Alias)
+		}
+	}
+	var firstErr error
+	for _, alias := range aliases {
+		aliasApp := *app
+		aliasApp.kubectlConfigPaths = nil
+		if err := aliasApp.getConfigSettings(alias); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		aliasApp.setKubeconfigPaths(kubeconfigFlag, envList, defaultKubeconfigPath)
+		report, err := aliasApp.logout(revoke)
+		for _, line := range report {
+			fmt.Fprintln(out, line) // nolint: errcheck
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogout(t *testing.T) {
+	Convey("logout", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		var revoked []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/logout" || r.Method != "POST" {
+				http.NotFound(w, r)
+				return
+			}
+			revoked = append(revoked, r.PostFormValue("refresh_token"))
+			json.NewEncoder(w).Encode(logoutResponse{Revoked: true, EndSessionURL: "https://idp.example.com/logout?id_token_hint=" + r.PostFormValue("id_token")}) // nolint: errcheck
+		}))
+		defer server.Close()
+		kubeconfig := filepath.Join(dir, "config")
+		So(ioutil.WriteFile(kubeconfig, []byte("users:\n- name: prod_oidc\n  user:\n    token: jwt # from kubelogin\n    username: kept\n- name: dev_oidc\n  user:\n    token: devjwt\n"), 0600), ShouldEqual, nil)
+		var app app
+		app.filenameWithPath = filepath.Join(dir, ".kubeloginrc.yaml")
+		app.tokenCacheDir = filepath.Join(dir, "cache")
+		var config Config
+		config.appendAlias(AliasConfig{Alias: "prod", BaseURL: server.URL, KubectlUser: "prod_oidc", RefreshToken: "refresh"})
+		config.appendAlias(AliasConfig{Alias: "dev", BaseURL: server.URL, KubectlUser: "dev_oidc"})
+		config.appendAlias(AliasConfig{Alias: "none", BaseURL: server.URL, KubectlUser: "none_oidc"})
+		So(config.writeToFile(app.filenameWithPath), ShouldEqual, nil)
+		cached := app
+		cached.kubeloginServer = server.URL
+		cached.kubectlUser = "prod_oidc"
+		So(cached.writeTokenCache("jwt"), ShouldEqual, nil)
+
+		Convey("should clear the token everywhere and report what it cleared", func() {
+			var out bytes.Buffer
+			So(app.logoutAliases([]string{"prod"}, false, false, "", kubeconfig, "", &out), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, "Removed the token of kubectl user prod_oidc from "+kubeconfig+"\nRemoved the cached token of prod\nRemoved the refresh token of alias prod\n")
+			contents, _ := ioutil.ReadFile(kubeconfig)
+			So(string(contents), ShouldNotContainSubstring, "token: jwt")
+			So(string(contents), ShouldContainSubstring, "username: kept")
+			So(string(contents), ShouldContainSubstring, "token: devjwt")
+			So(app.getConfigSettings("prod"), ShouldEqual, nil)
+			So(app.refreshToken, ShouldEqual, "")
+			So(revoked, ShouldBeEmpty)
+		})
+		Convey("should have the server revoke the refresh token when asked", func() {
+			var out bytes.Buffer
+			So(app.logoutAliases([]string{"prod"}, false, true, "", kubeconfig, "", &out), ShouldEqual, nil)
+			So(revoked, ShouldResemble, []string{"refresh"})
+			So(out.String(), ShouldStartWith, "Revoked the refresh token of prod at the identity provider\nOpen https://idp.example.com/logout?id_token_hint=jwt to end")
+		})
+		Convey("should not call the server for an alias without a refresh token", func() {
+			var out bytes.Buffer
+			So(app.logoutAliases([]string{"dev"}, false, true, "", kubeconfig, "", &out), ShouldEqual, nil)
+			So(revoked, ShouldBeEmpty)
+			So(out.String(), ShouldEqual, "Removed the token of kubectl user dev_oidc from "+kubeconfig+"\n")
+		})
+		Convey("should go on to the other aliases when one can't be found", func() {
+			var out bytes.Buffer
+			err := app.logoutAliases([]string{"missing", "dev"}, false, false, "", kubeconfig, "", &out)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "missing")
+			So(out.String(), ShouldEqual, "Removed the token of kubectl user dev_oidc from "+kubeconfig+"\n")
+		})
+		Convey("should log out of every alias", func() {
+			var out bytes.Buffer
+			So(app.logoutAliases(nil, true, false, "", kubeconfig, "", &out), ShouldEqual, nil)
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			So(lines, ShouldHaveLength, 5)
+			So(lines[3], ShouldEqual, "Removed the token of kubectl user dev_oidc from "+kubeconfig)
+			So(lines[4], ShouldEqual, "Nothing to clear for none")
+			contents, _ := ioutil.ReadFile(kubeconfig)
+			So(string(contents), ShouldNotContainSubstring, "token:")
+		})
+		Convey("should still clear local credentials when revoking fails", func() {
+			app.kubeloginServer = server.URL + "/nothing"
+			app.kubectlUser = "prod_oidc"
+			app.refreshToken = "refresh"
+			app.kubectlConfigPaths = []string{kubeconfig}
+			report, err := app.logout(true)
+			So(err, ShouldNotEqual, nil)
+			So(report, ShouldHaveLength, 1)
+			contents, _ := ioutil.ReadFile(kubeconfig)
+			So(string(contents), ShouldNotContainSubstring, "token: jwt")
+		})
+	})
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -12,10 +19,15 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	"path"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -24,40 +36,48 @@ import (
 )
 
 type app struct {
-	filenameWithPath  string
-	kubectlUser       string
-	kubectlConfigPath string
-	kubeloginAlias    string
-	kubeloginServer   string
-}
-
-type kubeYAML struct {
-	APIVersion string `yaml:"apiVersion"`
-	Clusters   []struct {
-		Cluster map[string]interface{} `yaml:"cluster"`
-		Name    string                 `yaml:"name"`
-	} `yaml:"clusters"`
-	Contexts []struct {
-		Context map[string]interface{} `yaml:"context"`
-		Name    string                 `yaml:"name"`
-	} `yaml:"contexts"`
-	CurrentContext string `yaml:"current-context"`
-	Kind           string `yaml:"kind"`
-	Preferences    struct {
-	} `yaml:"preferences"`
-	Users []k8User `yaml:"users"`
-}
-
-type k8User struct {
-	Name string                 `yaml:"name"`
-	User map[string]interface{} `yaml:"user"`
+	filenameWithPath string
+	kubectlUser      string
+	// kube config files in kubectl's order of precedence
+	kubectlConfigPaths []string
+	// cluster and context set up along with the token
+	kubectlContext  KubectlContext
+	kubeloginAlias  string
+	kubeloginServer string
+	// named provider on the kubelogin server, sent along with every login, refresh and logout
+	provider       string
+	tokenCacheDir  string
+	execCredential bool
+	codeVerifier   string
+	refreshToken   string
+	// sent to the server on /login and expected back on the callback, so only the redirect for this login is accepted
+	callbackSecret string
+	// makes sure only one request to the callback listener ever gets to exchange a token
+	exchangeOnce *sync.Once
+	// receives the outcome of the exchange the callback listener made
+	loginResult chan error
+	// how long to wait for the browser login; zero waits forever
+	loginTimeout time.Duration
 }
 
 var (
 	aliasFlag              string
 	userFlag               string
 	kubeloginServerBaseURL string
-	doneChannel            chan bool
+	providerFlag           string
+	apiVersionFlag         string
+	deviceFlag             bool
+	manualFlag             bool
+	timeoutFlag            time.Duration
+	minValidFlag           time.Duration
+	clockSkewFlag          time.Duration
+	kubeconfigFlag         string
+	kubectlContextFlags    KubectlContext
+	outputFlag             string
+	userClaimFlag          string
+	groupsClaimFlag        string
+	allFlag                bool
+	revokeFlag             bool
 	usageMessage           = `Kubelogin Usage:
   
   One time login:
@@ -66,150 +86,307 @@ var (
   Configure an alias (shortcut):
     kubelogin config --alias=example --server-url=https://kubelogin.example.com --kubectl-user=example_oidc
     
+  Configure an alias that also sets up the kubectl cluster and context on login:
+    kubelogin config --alias=example --server-url=https://kubelogin.example.com --kubectl-user=example_oidc \
+      --cluster=example --cluster-server=https://kubernetes.example.com --namespace=default --set-current-context
+
+  Configure an alias that logs in with one of the kubelogin server's named identity providers:
+    kubelogin config --alias=partner --server-url=https://kubelogin.example.com --kubectl-user=partner_oidc --provider=partners
+
+  Import aliases for the clusters a kubelogin server publishes, optionally only the named ones:
+    kubelogin config import --server-url=https://kubelogin.example.com [ALIAS...]
+
+  Manage aliases:
+    kubelogin config list [--output=json]
+    kubelogin config show [--output=json] example
+    kubelogin config delete example
+    kubelogin config rename example new-example
+    kubelogin config set-default example
+
   Use an alias:
     kubelogin login example
 
-	Check a token expiry against the current time. This exits with 1 if the token is stale, 0 if it is fresh.
+  Use the default alias:
+    kubelogin login
+
+  Log in from a machine without a browser, e.g. over SSH. Flags go before the alias:
+    kubelogin login --device example
+
+  Log in by pasting a code from the browser, when it can't reach this machine:
+    kubelogin login --manual example
+
+	Check a token expiry against the current time. This exits with 0 if the token is fresh, 1 if it has expired,
+  2 if it expires within --min-valid, 3 if the user has no token, 4 if the token is not a JWT, 5 if its claims
+  are malformed and 6 if it is not valid yet:
     kubelogin check example
-    kubelogin check --server-url=https://kubelogin.example.com --kubectl-user=user`
+    kubelogin check --min-valid=5m --output=json example
+    kubelogin check --server-url=https://kubelogin.example.com --kubectl-user=user
+
+  Log in only if the token expires within --min-valid (5m by default), refreshing it without the browser if
+  possible. This exits with 0 if the token was fresh, 2 if it was refreshed, 3 after a login and 1 on failure:
+    kubelogin ensure --min-valid=10m example
+
+  Show who the token of each alias says you are, which groups you're in and when it expires:
+    kubelogin status [--output=json] [example...]
+
+  Log out, removing the token from the kube config and the refresh token, and optionally revoking it at the
+  identity provider. Without an alias this logs out of the default alias:
+    kubelogin logout [--revoke] example
+    kubelogin logout --all
+
+  Print a client-go ExecCredential for kubectl, logging in only when the cached token is stale:
+    kubelogin get-token example
+    kubelogin get-token --server-url=https://kubelogin.example.com --kubectl-user=user`
 )
 
 //AliasConfig contains the structure of what's in the config file
 type AliasConfig struct {
-	Alias       string `yaml:"alias"`
-	BaseURL     string `yaml:"server-url"`
-	KubectlUser string `yaml:"kubectl-user"`
+	Alias        string `yaml:"alias"`
+	BaseURL      string `yaml:"server-url"`
+	KubectlUser  string `yaml:"kubectl-user"`
+	RefreshToken string `yaml:"refresh-token,omitempty"`
+	// named provider on the kubelogin server to log in with, empty for its default one
+	Provider string `yaml:"provider,omitempty"`
+	// kube config file for this alias, used instead of KUBECONFIG
+	Kubeconfig     string `yaml:"kubeconfig,omitempty"`
+	KubectlContext `yaml:",inline"`
+}
+
+// KubectlContext is the cluster and context an alias sets up in the kube config next to the user
+type KubectlContext struct {
+	Cluster                  string `yaml:"cluster,omitempty"`
+	Server                   string `yaml:"cluster-server,omitempty"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data,omitempty"`
+	Context                  string `yaml:"context,omitempty"`
+	Namespace                string `yaml:"namespace,omitempty"`
+	SetCurrentContext        bool   `yaml:"set-current-context,omitempty"`
+}
+
+// the context is named after the cluster unless told otherwise
+func (kc KubectlContext) contextName() string {
+	if kc.Context != "" {
+		return kc.Context
+	}
+	return kc.Cluster
+}
+
+func (kc KubectlContext) validate() error {
+	if kc.Cluster == "" && (kc.Server != "" || kc.CertificateAuthorityData != "") {
+		return fmt.Errorf("--cluster-server and --certificate-authority-data need --cluster")
+	}
+	if kc.contextName() == "" && (kc.Namespace != "" || kc.SetCurrentContext) {
+		return fmt.Errorf("--namespace and --set-current-context need --cluster or --context")
+	}
+	if kc.Server != "" {
+		if _, err := url.ParseRequestURI(kc.Server); err != nil {
+			return fmt.Errorf("invalid --cluster-server %v: %v", kc.Server, err)
+		}
+	}
+	if kc.CertificateAuthorityData != "" {
+		if _, err := base64.StdEncoding.DecodeString(kc.CertificateAuthorityData); err != nil {
+			return fmt.Errorf("--certificate-authority-data must be base64 encoded: %v", err)
+		}
+	}
+	return nil
 }
 
 // Config contains the array of aliases (AliasConfig)
 type Config struct {
+	// alias used when login, check or get-token are given neither an alias nor a server URL
+	Default string         `yaml:"default,omitempty"`
 	Aliases []*AliasConfig `yaml:"aliases"`
 }
 
-func findFreePort() (string, error) {
-	server, err := net.Listen("tcp", ":0")
-	if err != nil {
-		return "", err
+// The callback listener only needs to be reachable from the browser on this machine, so it never binds to
+// other interfaces. IPv6 is only tried on hosts without IPv4 loopback.
+func listenLoopback() (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err == nil {
+		return listener, nil
 	}
-	defer server.Close() // nolint: errcheck
-	hostString := server.Addr().String()
-	_, portString, err := net.SplitHostPort(hostString)
-	if err != nil {
+	return net.Listen("tcp", "[::1]:0")
+}
+
+// PKCE (RFC 7636) parameters. The verifier never leaves this process until the exchange, so a token
+// intercepted on its way back to the loopback listener is useless on its own.
+const (
+	codeVerifierSize         = 32
+	codeChallengeMethodS256  = "S256"
+	codeChallengeField       = "code_challenge"
+	codeChallengeMethodField = "code_challenge_method"
+	codeVerifierField        = "code_verifier"
+)
+
+// The callback listener only accepts requests carrying the secret it sent to /login, which the kubelogin
+// server hands back in the redirect. Other local processes or pages can't guess it.
+const (
+	callbackSecretSize      = 32
+	callbackSecretField     = "callback_secret"
+	callbackShutdownTimeout = 5 * time.Second
+	defaultLoginTimeout     = 5 * time.Minute
+)
+
+// picks one of the kubelogin server's named identity providers
+const providerField = "provider"
+
+var (
+	errLoginTimedOut  = errors.New("timed out waiting for the browser login")
+	errLoginCancelled = errors.New("login cancelled")
+	errUserNotFound   = errors.New("not found")
+)
+
+func newCodeVerifier() (string, error) {
+	return randomURLSafeString(codeVerifierSize)
+}
+
+func randomURLSafeString(size int) (string, error) {
+	random := make([]byte, size)
+	if _, err := rand.Read(random); err != nil {
 		return "", err
 	}
-	return portString, nil
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+func codeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
 }
 
 func (app *app) makeExchange(token string) error {
-	url := fmt.Sprintf("%s/exchange?token=%s", app.kubeloginServer, token)
-	req, err := http.NewRequest("GET", url, nil)
+	query := url.Values{}
+	query.Set("token", token)
+	query.Set(codeVerifierField, app.codeVerifier)
+	exchangeURL := fmt.Sprintf("%s/exchange?%s", app.kubeloginServer, query.Encode())
+	req, err := http.NewRequest("GET", exchangeURL, nil)
 	if err != nil {
 		log.Printf("Unable to create request. %s", err)
 		return err
 	}
+	req.Header.Set("Accept", "application/json")
 	client := http.DefaultClient
 	res, err := client.Do(req)
 	if err != nil {
 		log.Printf("Unable to make request. %s", err)
 		return err
 	}
+	defer res.Body.Close() // nolint: errcheck
 	if res.StatusCode != http.StatusOK {
-		log.Fatalf("Failed to retrieve token from kubelogin server. Please try again or contact your administrator")
+		return fmt.Errorf("failed to retrieve token from kubelogin server (%s). Please try again or contact your administrator", res.Status)
 	}
-	defer res.Body.Close() // nolint: errcheck
-	jwt, err := ioutil.ReadAll(res.Body)
+	tokens, err := readTokenResponse(res)
 	if err != nil {
 		log.Printf("Unable to read response body. %s", err)
 		return err
 	}
-	if err := app.configureKubectl(string(jwt)); err != nil {
+	if err := app.saveToken(tokens.Token); err != nil {
 		log.Printf("Error when setting credentials: %v", err)
 		return err
 	}
+	if err := app.saveRefreshToken(tokens.RefreshToken); err != nil {
+		log.Printf("Error when saving refresh token: %v", err)
+		return err
+	}
 	return nil
 }
 
-func (app *app) tokenHandler(w http.ResponseWriter, r *http.Request) {
-	token := r.FormValue("token")
-	if err := app.makeExchange(token); err != nil {
-		log.Fatalf("Could not exchange token for jwt %v", err)
+// When acting as a credential plugin the token is kept in kubelogin's own cache rather than in the
+// kubectl config file.
+func (app *app) saveToken(jwt string) error {
+	if app.execCredential {
+		return app.writeTokenCache(jwt)
 	}
-	fmt.Fprint(w, "You are now logged in! You can close this window")
-	doneChannel <- true
+	return app.configureKubectl(jwt)
 }
 
-// Pure function to test adding/editing token to kubectl config
-func editToken(k kubeYAML, username string, t string) kubeYAML {
-	found := false
-	// Look for existing users which match
-	for key, v := range k.Users {
-		if username == v.Name {
-			// We only care about a token entry, bypass the issues with client certs
-			v.User["token"] = t
-			k.Users[key] = v
-			found = true
-		}
+var resultPage = template.Must(template.New("result").Parse(`<!doctype html><html><head><title>Kubelogin</title></head><body><h1>Kubelogin</h1>{{if .}}<p>Login failed: {{.}}</p><p>Please run kubelogin login again.</p>{{else}}<p>You are now logged in! You can close this window</p>{{end}}</body></html>`))
+
+// tells the user in the browser how the login ended, so a failure doesn't leave them with an empty page
+func renderResultPage(w http.ResponseWriter, loginErr error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	var reason string
+	if loginErr != nil {
+		reason = loginErr.Error()
+		w.WriteHeader(http.StatusInternalServerError)
 	}
-	// We didn't find the user. Time to create one.
-	if !found {
-		var u k8User
-		u.Name = username
-		m := make(map[string]interface{})
-		m["token"] = t
-		u.User = m
-		k.Users = append(k.Users, u)
+	if err := resultPage.Execute(w, reason); err != nil {
+		log.Printf("Unable to write result page: %v", err)
 	}
-	return k
 }
 
-// Parses the kubectl file pointed to by the app, and returns the file or error.
-func (app *app) readKubectl() (*kubeYAML, error) {
-	kc, err := ioutil.ReadFile(app.kubectlConfigPath)
-	if err != nil {
-		return nil, fmt.Errorf("could not read kube config file: %v", err)
+// Anything that doesn't carry this login's callback secret is turned away before a token is exchanged.
+func (app *app) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
 	}
-
-	var ky kubeYAML
-	err = yaml.Unmarshal(kc, &ky)
-	if err != nil {
-		return nil, fmt.Errorf("could not unmarshal kube config: %v", err)
+	secret := r.FormValue(callbackSecretField)
+	if app.callbackSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(app.callbackSecret)) != 1 {
+		fmt.Fprintln(os.Stderr, "Ignored a request to the login callback that did not come from this login")
+		http.Error(w, "This request does not belong to the login kubelogin started", http.StatusForbidden)
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "No token in request", http.StatusBadRequest)
+		return
+	}
+	exchanged := false
+	app.exchangeOnce.Do(func() {
+		exchanged = true
+		err := app.makeExchange(token)
+		renderResultPage(w, err)
+		app.loginResult <- err
+	})
+	if !exchanged {
+		http.Error(w, "This login is already complete", http.StatusConflict)
 	}
-	return &ky, nil
 }
 
-func (app *app) configureKubectl(jwt string) error {
-	ky, err := app.readKubectl()
+// builds the login URL that has the server redirect back to the callback listener on the given loopback address
+func (app *app) generateAuthURL(host, portNum string) (string, error) {
+	var err error
+	app.callbackSecret, err = randomURLSafeString(callbackSecretSize)
 	if err != nil {
-		log.Fatalf("%v", err)
-	}
-
-	// Edit or add user in pure function (for testing purposes)
-	uy := editToken(*ky, app.kubectlUser, jwt)
-
-	out, e := yaml.Marshal(&uy)
-	if e != nil {
-		log.Fatalf("could not write kube config: %v", e)
+		log.Print("err, could not generate a callback secret")
+		return "", err
 	}
+	return app.loginURL(url.Values{"host": {host}, "port": {portNum}, callbackSecretField: {app.callbackSecret}})
+}
 
-	// Avoid guessing at appropriate file mode later
-	fi, err := os.Stat(app.kubectlConfigPath)
+// adds a fresh PKCE challenge to the login query, keeping the verifier for makeExchange
+func (app *app) loginURL(query url.Values) (string, error) {
+	var err error
+	app.codeVerifier, err = newCodeVerifier()
 	if err != nil {
-		log.Fatalf("could not stat kube config: %v", err)
+		log.Print("err, could not generate a code verifier")
+		return "", err
 	}
-
-	return ioutil.WriteFile(app.kubectlConfigPath, out, fi.Mode())
+	query.Set(codeChallengeField, codeChallengeS256(app.codeVerifier))
+	query.Set(codeChallengeMethodField, codeChallengeMethodS256)
+	if app.provider != "" {
+		query.Set(providerField, app.provider)
+	}
+	return fmt.Sprintf("%s/login?%s", app.kubeloginServer, query.Encode()), nil
 }
 
-func (app *app) generateAuthURL() (string, string, error) {
-	portNum, err := findFreePort()
+// For when the browser can't reach this machine: the server shows the exchange token on a page instead of
+// redirecting to localhost, and the user pastes it here.
+func (app *app) manualLogin(in io.Reader, out io.Writer) error {
+	loginURL, err := app.loginURL(url.Values{"manual": {"true"}})
 	if err != nil {
-		log.Print("err, could not find an open port")
-		return "", "", err
+		return err
 	}
-
-	loginURL := fmt.Sprintf("%s/login?port=%s", app.kubeloginServer, portNum)
-
-	return loginURL, portNum, nil
+	fmt.Fprintf(out, "Open this URL in a browser on any machine and log in:\n%s\n", loginURL) // nolint: errcheck
+	fmt.Fprint(out, "Paste the code shown after logging in: ")                                // nolint: errcheck
+	code, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "failed to read the code")
+	}
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return fmt.Errorf("no code was entered")
+	}
+	return app.makeExchange(code)
 }
 
 func createMux(app app) *http.ServeMux {
@@ -226,52 +403,120 @@ func createMux(app app) *http.ServeMux {
 	return newMux
 }
 
-func generateURLAndListenForServerResponse(app app) {
-	loginURL, portNum, err := app.generateAuthURL()
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	doneChannel = make(chan bool)
-	go func() {
-		l, err := net.Listen("tcp", ":"+portNum)
+// opens the login URL in the default browser; a variable so tests don't open real browsers
+var openBrowser = func(loginURL string) {
+	if runtime.GOOS == "darwin" {
+		// On OS X, run the `open` CLI to use the default browser to open the login URL.
+		fmt.Fprintf(os.Stderr, "Opening %s ...\n", loginURL)
+		err := exec.Command("/usr/bin/open", loginURL).Run()
 		if err != nil {
-			fmt.Printf("Error listening on port: %s. Error: %v\n", portNum, err)
-			os.Exit(1)
-		}
-		if runtime.GOOS == "darwin" {
-			// On OS X, run the `open` CLI to use the default browser to open the login URL.
-			fmt.Printf("Opening %s ...\n", loginURL)
-			err := exec.Command("/usr/bin/open", loginURL).Run()
-			if err != nil {
-				fmt.Printf("Error opening; please open the URL manually: %s \n", loginURL)
-			}
+			fmt.Fprintf(os.Stderr, "Error opening; please open the URL manually: %s \n", loginURL)
 		}
-		if runtime.GOOS == "linux" {
-			// On linux, run the `xdg-open` CLI to use the default browser to open the login URL.
-			fmt.Printf("Opening %s...\n", loginURL)
-			err := exec.Command("/usr/bin/xdg-open", loginURL).Run()
-			if err != nil {
-				fmt.Printf("Consider installing 'xdg-open' utility or open the URL manually: %s \n", loginURL)
-			}
-		} else {
-			fmt.Printf("Follow this URL to log into auth provider: %s\n", loginURL)
-		}
-		if err = http.Serve(l, createMux(app)); err != nil {
-			fmt.Printf("Error listening on port: %s. Error: %v\n", portNum, err)
-			os.Exit(1)
+	}
+	if runtime.GOOS == "linux" {
+		// On linux, run the `xdg-open` CLI to use the default browser to open the login URL.
+		fmt.Fprintf(os.Stderr, "Opening %s...\n", loginURL)
+		err := exec.Command("/usr/bin/xdg-open", loginURL).Run()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Consider installing 'xdg-open' utility or open the URL manually: %s \n", loginURL)
 		}
+	} else {
+		fmt.Fprintf(os.Stderr, "Follow this URL to log into auth provider: %s\n", loginURL)
+	}
+}
+
+// Runs the browser login and waits for the callback listener to report how the exchange went. Gives up
+// when the timeout passes or the user interrupts, and always shuts the listener down before returning.
+func generateURLAndListenForServerResponse(app app) error {
+	listener, err := listenLoopback()
+	if err != nil {
+		return errors.Wrap(err, "failed to listen on loopback for the login callback")
+	}
+	address := listener.Addr().(*net.TCPAddr)
+	portNum := strconv.Itoa(address.Port)
+	loginURL, err := app.generateAuthURL(address.IP.String(), portNum)
+	if err != nil {
+		listener.Close() // nolint: errcheck
+		return err
+	}
+	app.exchangeOnce = &sync.Once{}
+	app.loginResult = make(chan error, 1)
+	server := &http.Server{Handler: createMux(app)}
+	serveResult := make(chan error, 1)
+	go func() {
+		serveResult <- server.Serve(listener)
 	}()
-	<-doneChannel
-	fmt.Println("You are now logged in! Enjoy kubectl-ing!")
-	time.Sleep(1 * time.Second)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	var timeout <-chan time.Time
+	if app.loginTimeout > 0 {
+		timer := time.NewTimer(app.loginTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	go openBrowser(loginURL)
+
+	var result error
+	select {
+	case result = <-app.loginResult:
+	case err := <-serveResult:
+		result = errors.Wrap(err, "login callback listener stopped")
+	case <-timeout:
+		result = errors.Wrapf(errLoginTimedOut, "no login within %v", app.loginTimeout)
+	case <-interrupt:
+		result = errLoginCancelled
+	}
+	// lets the browser's request finish before the listener goes away
+	ctx, cancel := context.WithTimeout(context.Background(), callbackShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Error shutting down the login callback listener: %v\n", err)
+	}
+	return result
+}
+
+// the word after the verb, for verbs like config that have their own verbs
+func subcommand(args []string) string {
+	if len(args) < 3 {
+		return ""
+	}
+	return args[2]
+}
+
+// Runs the login the flags ask for: a device login, a manual one, or the browser redirecting back to the
+// callback listener.
+func (app *app) interactiveLogin(manual, device bool, timeout time.Duration) error {
+	if manual {
+		return app.manualLogin(os.Stdin, os.Stderr)
+	}
+	if device {
+		return app.deviceLogin(os.Stderr)
+	}
+	app.loginTimeout = timeout
+	return generateURLAndListenForServerResponse(*app)
+}
+
+// exits non-zero with the reason the login failed; an interrupted login exits like an interrupted process
+func exitLoginFailed(err error) {
+	fmt.Fprintf(os.Stderr, "Login failed: %v\n", err)
+	if errors.Cause(err) == errLoginCancelled {
+		os.Exit(130)
+	}
+	os.Exit(1)
 }
 
 func setFlags(command *flag.FlagSet, loginCmd bool) {
 	if !loginCmd {
 		command.StringVar(&aliasFlag, "alias", "default", "alias name in the config file, used for an easy login")
 	}
+	if loginCmd {
+		command.DurationVar(&timeoutFlag, "timeout", defaultLoginTimeout, "how long to wait for the browser login before giving up, 0 waits forever")
+	}
 	command.StringVar(&userFlag, "kubectl-user", "kubelogin_user", "in kubectl config, username used to store credentials")
 	command.StringVar(&kubeloginServerBaseURL, "server-url", "", "base URL of the kubelogin server, ex: https://kubelogin.example.com")
+	command.StringVar(&providerFlag, "provider", "", "named identity provider on the kubelogin server, if it has more than one")
+	command.StringVar(&kubeconfigFlag, "kubeconfig", "", "kube config file to use instead of KUBECONFIG or ~/.kube/config")
 }
 
 func (app *app) getConfigSettings(alias string) error {
@@ -288,8 +533,15 @@ func (app *app) getConfigSettings(alias string) error {
 	if !ok {
 		return fmt.Errorf("Could not find the alias '%s', in config file %s, check spelling or use the 'config' verb to create an alias", alias, app.filenameWithPath)
 	}
+	app.kubeloginAlias = aliasConfig.Alias
 	app.kubectlUser = aliasConfig.KubectlUser
 	app.kubeloginServer = aliasConfig.BaseURL
+	app.refreshToken = aliasConfig.RefreshToken
+	app.provider = aliasConfig.Provider
+	if aliasConfig.Kubeconfig != "" {
+		app.kubectlConfigPaths = []string{aliasConfig.Kubeconfig}
+	}
+	app.kubectlContext = aliasConfig.KubectlContext
 	return nil
 }
 
@@ -302,25 +554,11 @@ func (config *Config) aliasSearch(alias string) (*AliasConfig, bool) {
 	return nil, false
 }
 
-func (config *Config) createConfig(onDiskFile string, aliasConfig AliasConfig) error {
+func (config *Config) createConfig(aliasConfig AliasConfig) {
 	log.Print("Couldn't find config file in root directory. Creating config file...")
-	_, e := os.Stat(onDiskFile) // Does config file exist?
-	if os.IsNotExist(e) {       // Create file
-		fh, err := os.Create(onDiskFile)
-		if err != nil {
-			return errors.Wrap(err, "failed to create file in root directory")
-		}
-		_ = fh.Close()
-	}
-
-	log.Print("Config file created, setting config values...")
 	config.Aliases = make([]*AliasConfig, 0)
 	config.appendAlias(aliasConfig)
-	if err := config.writeToFile(onDiskFile); err != nil {
-		log.Fatal(err)
-	}
 	log.Print("File configured")
-	return nil
 }
 
 func (config *Config) newAliasConfig(kubeloginrcAlias, loginServerURL, kubectlUser string) AliasConfig {
@@ -341,52 +579,116 @@ func (config *Config) writeToFile(onDiskFile string) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal alias yaml")
 	}
-	if err := ioutil.WriteFile(onDiskFile, marshaledYaml, 0600); err != nil {
+	if err := writeFileLocked(onDiskFile, marshaledYaml, 0600); err != nil {
 		return errors.Wrap(err, "failed to write to kubeloginrc file with the alias")
 	}
-	log.Printf(string(marshaledYaml))
 	return nil
 }
 
-func (config *Config) updateAlias(aliasConfig *AliasConfig, loginServerURL *url.URL, onDiskFile string) error {
-	aliasConfig.KubectlUser = userFlag
-	aliasConfig.BaseURL = loginServerURL.String()
-	if err := config.writeToFile(onDiskFile); err != nil {
-		log.Fatal(err)
+// Applies the edit to the kubeloginrc file while holding its lock, so a change another kubelogin made since
+// the file was last read isn't lost. A missing file is edited as an empty one and created.
+func editConfigFile(onDiskFile string, edit func(config *Config) error) error {
+	if err := os.MkdirAll(filepath.Dir(onDiskFile), 0700); err != nil {
+		return errors.Wrap(err, "failed to create the kubeloginrc directory")
 	}
-	log.Print("Alias updated")
-	return nil
-}
-
-func (app *app) configureFile(kubeloginrcAlias string, loginServerURL *url.URL, kubectlUser string) error {
-	var config Config
-	aliasConfig := config.newAliasConfig(kubeloginrcAlias, loginServerURL.String(), kubectlUser)
-	yamlFile, err := ioutil.ReadFile(app.filenameWithPath)
+	unlock, err := lockFile(onDiskFile)
 	if err != nil {
-		return config.createConfig(app.filenameWithPath, aliasConfig) // Either error or nil value
+		return err
+	}
+	defer unlock()
+	var config Config
+	yamlFile, err := ioutil.ReadFile(onDiskFile)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to read config file")
 	}
 	if err := yaml.Unmarshal(yamlFile, &config); err != nil {
 		return errors.Wrap(err, "failed to unmarshal yaml file")
 	}
-	foundAliasConfig, ok := config.aliasSearch(aliasFlag)
-	if !ok {
-		newConfig := config.newAliasConfig(kubeloginrcAlias, loginServerURL.String(), kubectlUser)
-		config.appendAlias(newConfig)
-		if err := config.writeToFile(app.filenameWithPath); err != nil {
-			log.Fatal(err)
+	if err := edit(&config); err != nil {
+		return err
+	}
+	marshaledYaml, err := yaml.Marshal(&config)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal alias yaml")
+	}
+	if err := writeFileAtomic(onDiskFile, marshaledYaml, 0600); err != nil {
+		return errors.Wrap(err, "failed to write to kubeloginrc file with the alias")
+	}
+	return nil
+}
+
+// Only the settings whose flags were given, by name in changed, replace the alias's. A refresh token is only
+// good with the server that issued it, so it is dropped when the server URL changes.
+func (config *Config) updateAlias(aliasConfig *AliasConfig, loginServerURL *url.URL, changed map[string]bool) {
+	if aliasConfig.BaseURL != loginServerURL.String() {
+		aliasConfig.BaseURL = loginServerURL.String()
+		aliasConfig.RefreshToken = ""
+	}
+	if changed["kubectl-user"] {
+		aliasConfig.KubectlUser = userFlag
+	}
+	if changed["provider"] {
+		aliasConfig.Provider = providerFlag
+	}
+	if changed["kubeconfig"] {
+		aliasConfig.Kubeconfig = kubeconfigFlag
+	}
+	if changed["cluster"] {
+		aliasConfig.Cluster = kubectlContextFlags.Cluster
+	}
+	if changed["cluster-server"] {
+		aliasConfig.Server = kubectlContextFlags.Server
+	}
+	if changed["certificate-authority-data"] {
+		aliasConfig.CertificateAuthorityData = kubectlContextFlags.CertificateAuthorityData
+	}
+	if changed["context"] {
+		aliasConfig.Context = kubectlContextFlags.Context
+	}
+	if changed["namespace"] {
+		aliasConfig.Namespace = kubectlContextFlags.Namespace
+	}
+	if changed["set-current-context"] {
+		aliasConfig.SetCurrentContext = kubectlContextFlags.SetCurrentContext
+	}
+	log.Print("Alias updated")
+}
+
+// changed names the config flags that were given on the command line
+func (app *app) configureFile(kubeloginrcAlias string, loginServerURL *url.URL, kubectlUser string, changed map[string]bool) error {
+	return editConfigFile(app.filenameWithPath, func(config *Config) error {
+		foundAliasConfig, ok := config.aliasSearch(kubeloginrcAlias)
+		if ok {
+			updated := *foundAliasConfig
+			config.updateAlias(&updated, loginServerURL, changed)
+			if err := updated.KubectlContext.validate(); err != nil {
+				return err
+			}
+			*foundAliasConfig = updated
+			return nil
+		}
+		aliasConfig := config.newAliasConfig(kubeloginrcAlias, loginServerURL.String(), kubectlUser)
+		aliasConfig.Provider = providerFlag
+		aliasConfig.Kubeconfig = kubeconfigFlag
+		aliasConfig.KubectlContext = kubectlContextFlags
+		if err := aliasConfig.KubectlContext.validate(); err != nil {
+			return err
 		}
+		if len(config.Aliases) == 0 {
+			config.createConfig(aliasConfig)
+			return nil
+		}
+		config.appendAlias(aliasConfig)
 		log.Print("New Alias configured")
 		return nil
-	}
-
-	return config.updateAlias(foundAliasConfig, loginServerURL, app.filenameWithPath) // Either error or nil value
+	})
 }
 
-// Returns true if the token in the kube config section pointed to by the app is valid.
-func (app *app) checkTokenForFreshness() (bool, error) {
+// Returns the token of the app's user in the kube config.
+func (app *app) kubeconfigToken() (string, error) {
 	yaml, err := app.readKubectl()
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
 	var jwt string
@@ -395,54 +697,116 @@ func (app *app) checkTokenForFreshness() (bool, error) {
 			var ok bool
 			jwt, ok = k8User.User["token"].(string)
 			if !ok {
-				return false, fmt.Errorf("User %s has a non-string token; could not parse", app.kubectlUser)
+				return "", fmt.Errorf("User %s has a non-string token; could not parse", app.kubectlUser)
 			}
 		}
 	}
 	if jwt == "" {
-		return false, fmt.Errorf("User %s not found", app.kubectlUser)
+		return "", errors.Wrapf(errUserNotFound, "User %s", app.kubectlUser)
 	}
-	// JWTs are dot-separated base64-encoded JSON payloads. We're only checking the expiry time.
-	// See https://en.wikipedia.org/wiki/JSON_Web_Token for details.
+	return jwt, nil
+}
+
+// Whether the kube config has kubectl run a credential plugin, get-token, for the app's user instead of
+// holding a token.
+func (app *app) kubeconfigRunsPlugin() bool {
+	kubeconfig, err := app.readKubectl()
+	if err != nil {
+		return false
+	}
+	for _, k8User := range kubeconfig.Users {
+		if k8User.Name == app.kubectlUser {
+			_, ok := k8User.User["exec"]
+			return ok
+		}
+	}
+	return false
+}
+
+// JWTs are dot-separated base64-encoded JSON payloads. This only decodes the payload; it does
+// not verify the signature.
+// See https://en.wikipedia.org/wiki/JSON_Web_Token for details.
+func decodeJWTPayload(jwt string) (map[string]interface{}, error) {
 	splitJwt := strings.Split(jwt, ".")
 	if len(splitJwt) < 2 {
-		return false, fmt.Errorf("JWT for %s not in proper format", app.kubectlUser)
+		return nil, fmt.Errorf("JWT not in proper format")
 	}
-	decodedPayload, err := base64.RawStdEncoding.DecodeString(splitJwt[1])
+	decodedPayload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(splitJwt[1], "="))
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	var jsonPayload map[string]interface{}
-	err = json.Unmarshal(decodedPayload, &jsonPayload)
+	if err := json.Unmarshal(decodedPayload, &jsonPayload); err != nil {
+		return nil, err
+	}
+	return jsonPayload, nil
+}
+
+// Returns the time held in the exp claim of the JWT.
+func parseJWTExpiry(jwt string) (time.Time, error) {
+	jsonPayload, err := decodeJWTPayload(jwt)
 	if err != nil {
-		return false, err
+		return time.Time{}, err
 	}
 	expiryTimestampFloat, ok := jsonPayload["exp"].(float64)
 	if !ok {
-		return false, fmt.Errorf("JWT value %v not a number", jsonPayload["exp"])
+		return time.Time{}, fmt.Errorf("JWT value %v not a number", jsonPayload["exp"])
 	}
-	now := time.Now()
-	expiry := time.Unix(int64(expiryTimestampFloat), 0)
-
-	return expiry.After(now), nil
+	return time.Unix(int64(expiryTimestampFloat), 0), nil
 }
 
 func main() {
 	var app app
 	loginCommand := flag.NewFlagSet("login", flag.ExitOnError)
 	setFlags(loginCommand, true)
+	loginCommand.BoolVar(&manualFlag, "manual", false, "paste the code shown in the browser instead of having the browser send it to this machine")
+	loginCommand.BoolVar(&manualFlag, "no-browser", false, "same as --manual")
+	loginCommand.BoolVar(&deviceFlag, "device", false, "log in with a code entered in a browser on any machine, for when the browser can't reach this one")
 	configCommand := flag.NewFlagSet("config", flag.ExitOnError)
 	setFlags(configCommand, false)
+	configCommand.StringVar(&kubectlContextFlags.Cluster, "cluster", "", "in kubectl config, cluster to create or update on login")
+	configCommand.StringVar(&kubectlContextFlags.Server, "cluster-server", "", "API server URL of the cluster, ex: https://kubernetes.example.com")
+	configCommand.StringVar(&kubectlContextFlags.CertificateAuthorityData, "certificate-authority-data", "", "base64 encoded CA certificate of the cluster")
+	configCommand.StringVar(&kubectlContextFlags.Context, "context", "", "in kubectl config, context to create or update on login; defaults to the cluster name")
+	configCommand.StringVar(&kubectlContextFlags.Namespace, "namespace", "", "default namespace of the context")
+	configCommand.BoolVar(&kubectlContextFlags.SetCurrentContext, "set-current-context", false, "make the context the current one on login")
+	aliasCommand := flag.NewFlagSet("config", flag.ExitOnError)
+	aliasCommand.StringVar(&outputFlag, "output", "", "output format: table or json for list, yaml or json for show")
+	importCommand := flag.NewFlagSet("config import", flag.ExitOnError)
+	importCommand.StringVar(&kubeloginServerBaseURL, "server-url", "", "base URL of the kubelogin server to import the cluster catalog from")
+	ensureCommand := flag.NewFlagSet("ensure", flag.ExitOnError)
+	setFlags(ensureCommand, true)
+	ensureCommand.BoolVar(&manualFlag, "manual", false, "paste the code shown in the browser if a login is needed")
+	ensureCommand.BoolVar(&manualFlag, "no-browser", false, "same as --manual")
+	ensureCommand.BoolVar(&deviceFlag, "device", false, "use a device login if a login is needed")
+	ensureCommand.DurationVar(&minValidFlag, "min-valid", defaultMinValid, "how long the token must stay valid for no login to be needed")
+	ensureCommand.DurationVar(&clockSkewFlag, "clock-skew", defaultClockSkew, "how far this machine's clock may be off from the identity provider's")
 	checkCommand := flag.NewFlagSet("check", flag.ExitOnError)
 	setFlags(checkCommand, false)
+	checkCommand.DurationVar(&minValidFlag, "min-valid", 0, "how long the token must stay valid to count as fresh")
+	checkCommand.DurationVar(&clockSkewFlag, "clock-skew", defaultClockSkew, "how far this machine's clock may be off from the identity provider's")
+	checkCommand.StringVar(&outputFlag, "output", "", "json prints the result as JSON on stdout")
+	statusCommand := flag.NewFlagSet("status", flag.ExitOnError)
+	setFlags(statusCommand, false)
+	statusCommand.StringVar(&outputFlag, "output", tableOutput, "output format: table, json or yaml")
+	statusCommand.StringVar(&userClaimFlag, "user-claim", defaultUserClaim, "claim holding the user name, as set by USER_CLAIM on the server")
+	statusCommand.StringVar(&groupsClaimFlag, "groups-claim", defaultGroupsClaim, "claim holding the groups, as set by GROUPS_CLAIM on the server")
+	logoutCommand := flag.NewFlagSet("logout", flag.ExitOnError)
+	setFlags(logoutCommand, false)
+	logoutCommand.BoolVar(&allFlag, "all", false, "log out of every alias")
+	logoutCommand.BoolVar(&revokeFlag, "revoke", false, "have the kubelogin server revoke the refresh token at the identity provider")
+	getTokenCommand := flag.NewFlagSet("get-token", flag.ExitOnError)
+	setFlags(getTokenCommand, true)
+	getTokenCommand.StringVar(&apiVersionFlag, "api-version", execCredentialV1beta1, "ExecCredential apiVersion to print when kubectl does not set "+kubernetesExecInfoEnv)
 	user, err := user.Current()
 	if err != nil {
 		log.Fatalf("Could not determine current user of this system. Err: %v", err)
 	}
 	app.filenameWithPath = path.Join(user.HomeDir, "/.kubeloginrc.yaml")
-	app.kubectlConfigPath = path.Join(user.HomeDir, ".kube", "config")
+	defaultKubeconfigPath := path.Join(user.HomeDir, ".kube", "config")
+	app.tokenCacheDir = path.Join(user.HomeDir, ".kube", "cache", "kubelogin")
 
-	if len(os.Args) < 3 {
+	if len(os.Args) < 2 {
 		fmt.Println(usageMessage)
 		os.Exit(1)
 	}
@@ -454,10 +818,14 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		alias := command.Arg(0)
+		if alias == "" && kubeloginServerBaseURL == "" {
+			alias = app.defaultAlias()
+		}
 		// If the user provides an alias, use that; else, use the flag values.
-		if command.NArg() > 0 {
+		if alias != "" {
 			// Take user & server from the config file.
-			if err := app.getConfigSettings(command.Arg(0)); err != nil {
+			if err := app.getConfigSettings(alias); err != nil {
 				log.Fatal(err)
 			}
 		} else {
@@ -466,14 +834,59 @@ func main() {
 			}
 			app.kubectlUser = userFlag
 			app.kubeloginServer = kubeloginServerBaseURL
+			app.provider = providerFlag
 		}
+		app.setKubeconfigPaths(kubeconfigFlag, os.Getenv(kubeconfigEnv), defaultKubeconfigPath)
 	}
 
 	switch os.Args[1] {
 	case "login":
 		setLoginInfo(loginCommand)
-		generateURLAndListenForServerResponse(app)
+		if deviceFlag && manualFlag {
+			log.Fatal("--device and --manual can't be used together")
+		}
+		if app.refreshWithoutBrowser() {
+			fmt.Fprintln(os.Stderr, "Your token has been refreshed! Enjoy kubectl-ing!")
+			os.Exit(0)
+		}
+		if err := app.interactiveLogin(manualFlag, deviceFlag, timeoutFlag); err != nil {
+			exitLoginFailed(err)
+		}
+		fmt.Fprintln(os.Stderr, "You are now logged in! Enjoy kubectl-ing!")
+	case "ensure":
+		setLoginInfo(ensureCommand)
+		if deviceFlag && manualFlag {
+			log.Fatal("--device and --manual can't be used together")
+		}
+		code, err := app.ensure(minValidFlag, clockSkewFlag, func() error {
+			return app.interactiveLogin(manualFlag, deviceFlag, timeoutFlag)
+		}, os.Stderr)
+		if err != nil {
+			exitLoginFailed(err)
+		}
+		os.Exit(code)
 	case "config":
+		if _, ok := aliasVerbArgs[subcommand(os.Args)]; ok {
+			_ = aliasCommand.Parse(os.Args[3:])
+			if err := app.manageAliases(os.Args[2], aliasCommand.Args(), outputFlag, os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(0)
+		}
+		if subcommand(os.Args) == "import" {
+			_ = importCommand.Parse(os.Args[3:])
+			if kubeloginServerBaseURL == "" {
+				log.Fatal("--server-url must be set!")
+			}
+			verifiedServerURL, err := url.ParseRequestURI(kubeloginServerBaseURL)
+			if err != nil {
+				log.Fatalf("Invalid URL given: %v | Err: %v", kubeloginServerBaseURL, err)
+			}
+			if err := app.importCatalog(strings.TrimSuffix(verifiedServerURL.String(), "/"), importCommand.Args(), os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(0)
+		}
 		_ = configCommand.Parse(os.Args[2:])
 		if configCommand.Parsed() {
 			if kubeloginServerBaseURL == "" {
@@ -483,22 +896,85 @@ func main() {
 			if err != nil {
 				log.Fatalf("Invalid URL given: %v | Err: %v", kubeloginServerBaseURL, err)
 			}
-
-			if err := app.configureFile(aliasFlag, verifiedServerURL, userFlag); err != nil {
+			changed := map[string]bool{}
+			configCommand.Visit(func(f *flag.Flag) { changed[f.Name] = true })
+			if err := app.configureFile(aliasFlag, verifiedServerURL, userFlag, changed); err != nil {
 				log.Fatal(err)
 			}
 			os.Exit(0)
 		}
 	case "check":
 		setLoginInfo(checkCommand)
-		isFresh, err := app.checkTokenForFreshness()
+		check, err := app.checkToken(minValidFlag, clockSkewFlag)
+		if err == nil && check.State != tokenFresh && app.refreshWithoutBrowser() {
+			check, err = app.checkToken(minValidFlag, clockSkewFlag)
+		}
 		if err != nil {
 			log.Fatalf("Error reading token: %v", err)
 		}
-		if isFresh {
-			os.Exit(0)
+		// scripts only reading the exit code don't want the text on stdout
+		out := os.Stderr
+		if outputFlag == jsonOutput {
+			out = os.Stdout
+		}
+		if err := writeCheck(out, check, outputFlag); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(checkExitCodes[check.State])
+	case "status", "whoami":
+		_ = statusCommand.Parse(os.Args[2:])
+		var statuses []tokenStatus
+		if kubeloginServerBaseURL != "" && statusCommand.NArg() == 0 {
+			app.kubectlUser = userFlag
+			app.kubeloginServer = kubeloginServerBaseURL
+			app.setKubeconfigPaths(kubeconfigFlag, os.Getenv(kubeconfigEnv), defaultKubeconfigPath)
+			statuses = []tokenStatus{app.tokenStatus(userClaimFlag, groupsClaimFlag, time.Now())}
 		} else {
-			os.Exit(1)
+			statuses, err = app.aliasStatuses(statusCommand.Args(), kubeconfigFlag, os.Getenv(kubeconfigEnv), defaultKubeconfigPath, userClaimFlag, groupsClaimFlag)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := writeStatuses(os.Stdout, statuses, outputFlag); err != nil {
+			log.Fatal(err)
+		}
+	case "logout":
+		_ = logoutCommand.Parse(os.Args[2:])
+		if kubeloginServerBaseURL != "" && logoutCommand.NArg() == 0 && !allFlag {
+			app.kubectlUser = userFlag
+			app.kubeloginServer = kubeloginServerBaseURL
+			app.provider = providerFlag
+			app.setKubeconfigPaths(kubeconfigFlag, os.Getenv(kubeconfigEnv), defaultKubeconfigPath)
+			report, err := app.logout(revokeFlag)
+			for _, line := range report {
+				fmt.Println(line)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(0)
+		}
+		aliases := logoutCommand.Args()
+		if len(aliases) == 0 && !allFlag {
+			alias := app.defaultAlias()
+			if alias == "" {
+				log.Fatal("Give an alias to log out of, or --all or --server-url")
+			}
+			aliases = []string{alias}
+		}
+		if err := app.logoutAliases(aliases, allFlag, revokeFlag, kubeconfigFlag, os.Getenv(kubeconfigEnv), defaultKubeconfigPath, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case "get-token":
+		setLoginInfo(getTokenCommand)
+		app.execCredential = true
+		app.loginTimeout = timeoutFlag
+		apiVersion, err := execCredentialAPIVersion(os.Getenv(kubernetesExecInfoEnv), apiVersionFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := app.getToken(os.Stdout, apiVersion); err != nil {
+			log.Fatalf("Error getting token: %v", err)
 		}
 	default:
 		fmt.Println(usageMessage)
@@ -1,23 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
 	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	. "github.com/smartystreets/goconvey/convey"
-	yaml "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
-func TestFindFreePort(t *testing.T) {
-	Convey("findFreePort", t, func() {
-		Convey("should find a free port and return a port as a string if there is no error", func() {
-			port, _ := findFreePort()
-			So(port, ShouldNotEqual, nil)
+func TestListenLoopback(t *testing.T) {
+	Convey("listenLoopback", t, func() {
+		Convey("should listen on a free port on the loopback interface only", func() {
+			listener, err := listenLoopback()
+			So(err, ShouldEqual, nil)
+			defer listener.Close() // nolint: errcheck
+			address := listener.Addr().(*net.TCPAddr)
+			So(address.IP.IsLoopback(), ShouldBeTrue)
+			So(address.Port, ShouldNotEqual, 0)
 		})
 	})
 }
@@ -40,9 +53,144 @@ func TestMakeExchange(t *testing.T) {
 func TestGenerateAuthURL(t *testing.T) {
 	Convey("generateAuthURL", t, func() {
 		var app app
-		Convey("should return a url with a port based on the findFreePort function", func() {
-			url, _, _ := app.generateAuthURL()
-			So(url, ShouldNotEqual, nil)
+		Convey("should return a url with the address of the callback listener", func() {
+			loginURL, _ := app.generateAuthURL("127.0.0.1", "3000")
+			parsed, _ := url.Parse(loginURL)
+			So(parsed.Query().Get("port"), ShouldEqual, "3000")
+			So(parsed.Query().Get("host"), ShouldEqual, "127.0.0.1")
+		})
+		Convey("should send a new callback secret for every login", func() {
+			loginURL, _ := app.generateAuthURL("127.0.0.1", "3000")
+			parsed, _ := url.Parse(loginURL)
+			So(parsed.Query().Get(callbackSecretField), ShouldEqual, app.callbackSecret)
+			first := app.callbackSecret
+			_, _ = app.generateAuthURL("127.0.0.1", "3000")
+			So(app.callbackSecret, ShouldNotEqual, first)
+		})
+		Convey("should send the S256 challenge for the verifier it keeps", func() {
+			loginURL, err := app.generateAuthURL("127.0.0.1", "3000")
+			So(err, ShouldEqual, nil)
+			parsed, _ := url.Parse(loginURL)
+			So(parsed.Query().Get(codeChallengeField), ShouldEqual, codeChallengeS256(app.codeVerifier))
+			So(parsed.Query().Get(codeChallengeMethodField), ShouldEqual, codeChallengeMethodS256)
+		})
+	})
+}
+
+func TestManualLogin(t *testing.T) {
+	Convey("manualLogin", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		var received url.Values
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.URL.Query()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"token":"jwt"}`)) // nolint: errcheck
+		}))
+		defer server.Close()
+		var app app
+		app.kubeloginServer = server.URL
+		app.kubectlUser = "test"
+		app.execCredential = true
+		app.tokenCacheDir = dir
+		Convey("should ask for a manual login and exchange the pasted code with its verifier", func() {
+			var out bytes.Buffer
+			So(app.manualLogin(strings.NewReader("  hoopla \n"), &out), ShouldEqual, nil)
+			So(out.String(), ShouldContainSubstring, server.URL+"/login?")
+			So(out.String(), ShouldContainSubstring, "manual=true")
+			So(received.Get("token"), ShouldEqual, "hoopla")
+			So(received.Get(codeVerifierField), ShouldEqual, app.codeVerifier)
+			cached, _ := app.readTokenCache()
+			So(cached, ShouldEqual, "jwt")
+		})
+		Convey("should return an error if no code is entered", func() {
+			So(app.manualLogin(strings.NewReader("\n"), ioutil.Discard), ShouldNotEqual, nil)
+			So(received, ShouldBeNil)
+		})
+	})
+}
+
+func TestTokenHandler(t *testing.T) {
+	Convey("tokenHandler", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		exchanges := 0
+		refuse := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			exchanges++
+			if refuse {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("jwt")) // nolint: errcheck
+		}))
+		defer server.Close()
+		var app app
+		app.kubeloginServer = server.URL
+		app.kubectlUser = "test"
+		app.execCredential = true
+		app.tokenCacheDir = dir
+		app.callbackSecret = "secret"
+		app.exchangeOnce = &sync.Once{}
+		app.loginResult = make(chan error, 1)
+		callback := httptest.NewServer(createMux(app))
+		defer callback.Close()
+		var page string
+		get := func(query url.Values) int {
+			response, err := http.Get(callback.URL + "/exchange/client?" + query.Encode())
+			So(err, ShouldEqual, nil)
+			body, _ := ioutil.ReadAll(response.Body)
+			page = string(body)
+			response.Body.Close() // nolint: errcheck
+			return response.StatusCode
+		}
+		Convey("should refuse a request without the callback secret and not exchange its token", func() {
+			So(get(url.Values{"token": {"hoopla"}}), ShouldEqual, http.StatusForbidden)
+			So(get(url.Values{"token": {"hoopla"}, callbackSecretField: {"wrong"}}), ShouldEqual, http.StatusForbidden)
+			So(exchanges, ShouldEqual, 0)
+			So(app.loginResult, ShouldBeEmpty)
+		})
+		Convey("should exchange the token of the first request with the secret and then finish", func() {
+			So(get(url.Values{"token": {"hoopla"}, callbackSecretField: {"secret"}}), ShouldEqual, http.StatusOK)
+			So(exchanges, ShouldEqual, 1)
+			So(page, ShouldContainSubstring, "You are now logged in")
+			So(<-app.loginResult, ShouldEqual, nil)
+			So(get(url.Values{"token": {"hoopla"}, callbackSecretField: {"secret"}}), ShouldEqual, http.StatusConflict)
+			So(exchanges, ShouldEqual, 1)
+		})
+		Convey("should show the failure in the browser and hand it back instead of exiting", func() {
+			refuse = true
+			So(get(url.Values{"token": {"hoopla"}, callbackSecretField: {"secret"}}), ShouldEqual, http.StatusInternalServerError)
+			So(page, ShouldContainSubstring, "Login failed: failed to retrieve token from kubelogin server (401 Unauthorized)")
+			So(<-app.loginResult, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestGenerateURLAndListenForServerResponse(t *testing.T) {
+	Convey("generateURLAndListenForServerResponse", t, func() {
+		opened := make(chan string, 1)
+		original := openBrowser
+		openBrowser = func(loginURL string) { opened <- loginURL }
+		defer func() { openBrowser = original }()
+		var app app
+		app.kubeloginServer = "https://kubelogin.example.com"
+		Convey("should give up once the timeout passes", func() {
+			app.loginTimeout = 10 * time.Millisecond
+			err := generateURLAndListenForServerResponse(app)
+			So(errors.Cause(err), ShouldEqual, errLoginTimedOut)
+			select {
+			case loginURL := <-opened:
+				So(loginURL, ShouldStartWith, "https://kubelogin.example.com/login?")
+			case <-time.After(5 * time.Second):
+				t.Fatal("the browser was never opened")
+			}
 		})
 	})
 }
@@ -63,10 +211,97 @@ func TestConfigureKubectl(t *testing.T) {
 		userFlag = "auth_user"
 		var app app
 		app.kubectlUser = "test"
-		app.kubectlConfigPath = "testdata.yml"
 		Convey("should return nil upon setting the token correctly", func() {
-			err := app.configureKubectl("hoopla")
+			dir, err := ioutil.TempDir("", "kubelogin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir) // nolint: errcheck
+			kubeconfig, _ := ioutil.ReadFile("testdata.yml")
+			app.kubectlConfigPaths = []string{filepath.Join(dir, "config")}
+			So(ioutil.WriteFile(app.kubectlConfigPaths[0], kubeconfig, 0600), ShouldEqual, nil)
+			err = app.configureKubectl("hoopla")
+			So(err, ShouldEqual, nil)
+		})
+		Convey("should only change the token and keep everything else in the file", func() {
+			dir, err := ioutil.TempDir("", "kubelogin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir) // nolint: errcheck
+			app.kubectlConfigPaths = []string{filepath.Join(dir, "config")}
+			app.kubectlUser = "nonprod_oidc"
+			kubeconfig := `# managed by hand
+apiVersion: v1
+kind: Config
+preferences:
+  colors: true
+extensions:
+- name: example
+  extension:
+    hoopla: true
+users:
+- name: nonprod_oidc
+  user:
+    token: oldToken # replaced on login
+    certificate: otherCA.pem
+current-context: cluster-1-nonprod
+`
+			So(ioutil.WriteFile(app.kubectlConfigPaths[0], []byte(kubeconfig), 0600), ShouldEqual, nil)
+			So(app.configureKubectl("hoopla"), ShouldEqual, nil)
+			written, err := ioutil.ReadFile(app.kubectlConfigPaths[0])
 			So(err, ShouldEqual, nil)
+			So(string(written), ShouldEqual, strings.Replace(kubeconfig, "oldToken", "hoopla", 1))
+		})
+		Convey("should keep lists indented if the file has them that way", func() {
+			dir, err := ioutil.TempDir("", "kubelogin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir) // nolint: errcheck
+			app.kubectlConfigPaths = []string{filepath.Join(dir, "config")}
+			app.kubectlUser = "nonprod_oidc"
+			kubeconfig := "users:\n  - name: nonprod_oidc\n    user:\n      token: oldToken\n      exec:\n        args:\n          - one\n"
+			So(ioutil.WriteFile(app.kubectlConfigPaths[0], []byte(kubeconfig), 0600), ShouldEqual, nil)
+			So(app.configureKubectl("hoopla"), ShouldEqual, nil)
+			written, _ := ioutil.ReadFile(app.kubectlConfigPaths[0])
+			So(string(written), ShouldEqual, strings.Replace(kubeconfig, "oldToken", "hoopla", 1))
+		})
+		Convey("should leave every line of a kubectl written file but the token alone", func() {
+			dir, err := ioutil.TempDir("", "kubelogin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir) // nolint: errcheck
+			kubeconfig, _ := ioutil.ReadFile("testdata.yml")
+			app.kubectlConfigPaths = []string{filepath.Join(dir, "config")}
+			app.kubectlUser = "nonprod_oidc"
+			So(ioutil.WriteFile(app.kubectlConfigPaths[0], kubeconfig, 0600), ShouldEqual, nil)
+			So(app.configureKubectl("hoopla"), ShouldEqual, nil)
+			written, _ := ioutil.ReadFile(app.kubectlConfigPaths[0])
+			before, after := strings.Split(string(kubeconfig), "\n"), strings.Split(string(written), "\n")
+			So(after, ShouldHaveLength, len(before))
+			changed := 0
+			for i := range before {
+				if before[i] != after[i] {
+					changed++
+					So(after[i], ShouldContainSubstring, "token: hoopla")
+				}
+			}
+			So(changed, ShouldEqual, 1)
+		})
+		Convey("should start a users list in an empty file", func() {
+			dir, err := ioutil.TempDir("", "kubelogin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir) // nolint: errcheck
+			app.kubectlConfigPaths = []string{filepath.Join(dir, "config")}
+			So(ioutil.WriteFile(app.kubectlConfigPaths[0], nil, 0600), ShouldEqual, nil)
+			So(app.configureKubectl("hoopla"), ShouldEqual, nil)
+			written, err := ioutil.ReadFile(app.kubectlConfigPaths[0])
+			So(err, ShouldEqual, nil)
+			So(string(written), ShouldEqual, "users:\n- name: test\n  user:\n    token: hoopla\n")
 		})
 	})
 }
@@ -76,32 +311,47 @@ func TestEditToken(t *testing.T) {
 		kubectlUser := "nonprod_oidc"
 		token := "fancyToken"
 		Convey("should return nil upon setting the token correctly", func() {
-			kyaml, err := constructYaml()
+			doc, err := constructYaml()
 			if err != nil {
 				t.Error(err)
 			}
 			var u k8User
-			y := editToken(kyaml, kubectlUser, token)
-			ok, u := findUserStruct(y, kubectlUser)
+			So(editToken(doc, kubectlUser, token), ShouldEqual, nil)
+			ok, u := findUserStruct(doc, kubectlUser)
 			if !ok {
 				u.User["token"] = ""
 			}
 			So(u.User["token"], ShouldEqual, "fancyToken")
 		})
 		Convey("should construct a new user with token if user does not exist", func() {
-			kyaml, err := constructYaml()
+			doc, err := constructYaml()
 			if err != nil {
 				t.Error(err)
 			}
 			var u k8User
 			kubectlUser = "doesNotExist"
-			y := editToken(kyaml, kubectlUser, token)
-			ok, u := findUserStruct(y, kubectlUser)
+			So(editToken(doc, kubectlUser, token), ShouldEqual, nil)
+			ok, u := findUserStruct(doc, kubectlUser)
 			if !ok {
 				u.User["token"] = ""
 			}
 			So(u.User["token"], ShouldEqual, "fancyToken")
 		})
+		Convey("should remove the token given an empty one, without adding a missing user", func() {
+			doc, err := constructYaml()
+			if err != nil {
+				t.Error(err)
+			}
+			So(editToken(doc, "nonprod_oidc", token), ShouldEqual, nil)
+			So(editToken(doc, "nonprod_oidc", ""), ShouldEqual, nil)
+			ok, u := findUserStruct(doc, "nonprod_oidc")
+			So(ok, ShouldBeTrue)
+			_, hasToken := u.User["token"]
+			So(hasToken, ShouldBeFalse)
+			So(editToken(doc, "doesNotExist", ""), ShouldEqual, nil)
+			ok, _ = findUserStruct(doc, "doesNotExist")
+			So(ok, ShouldBeFalse)
+		})
 	})
 }
 
@@ -115,12 +365,12 @@ func TestConfigureFile(t *testing.T) {
 		app.filenameWithPath = fmt.Sprintf("%s/.test.yaml", user.HomeDir)
 		fakeURL, _ := url.Parse("bar")
 		Convey("should return nil if a file was able to be configured", func() {
-			err := app.configureFile("foo", fakeURL, "foobar")
+			err := app.configureFile("foo", fakeURL, "foobar", nil)
 			So(err, ShouldEqual, nil)
 		})
 		Convey("should return an err if a file failed to be configured", func() {
 			app.filenameWithPath = ""
-			err := app.configureFile("foo", fakeURL, "foobar")
+			err := app.configureFile("foo", fakeURL, "foobar", nil)
 			So(err, ShouldNotEqual, nil)
 		})
 	})
@@ -160,9 +410,9 @@ func TestCreateConfig(t *testing.T) {
 		app.filenameWithPath = fmt.Sprintf("%s/.test.yaml", user.HomeDir)
 		var config Config
 		var aliasConfig AliasConfig
-		Convey("should return nil upon creating the config file", func() {
-			err := config.createConfig(app.filenameWithPath, aliasConfig)
-			So(err, ShouldEqual, nil)
+		Convey("should start the config with the alias", func() {
+			config.createConfig(aliasConfig)
+			So(config.Aliases, ShouldResemble, []*AliasConfig{&aliasConfig})
 		})
 	})
 }
@@ -200,17 +450,45 @@ func TestUpdateAlias(t *testing.T) {
 		newAliasConfig.KubectlUser = "testuser"
 		config.Aliases = append(config.Aliases, &newAliasConfig)
 		fakeURL, _ := url.Parse("bar")
-		Convey("should return nil upon updating an entry in the config file", func() {
+		Convey("should update the entry from the flags", func() {
 			aliasFlag = "test"
 			userFlag = "test"
-			err := config.updateAlias(&newAliasConfig, fakeURL, app.filenameWithPath)
-			So(err, ShouldEqual, nil)
+			config.updateAlias(&newAliasConfig, fakeURL, map[string]bool{"kubectl-user": true})
+			So(newAliasConfig.KubectlUser, ShouldEqual, "test")
+		})
+		Convey("should keep the settings whose flags weren't given", func() {
+			newAliasConfig.Provider = "partners"
+			newAliasConfig.Kubeconfig = "/tmp/kubeconfig"
+			newAliasConfig.KubectlContext = KubectlContext{Cluster: "example", Namespace: "default"}
+			newAliasConfig.RefreshToken = "refresh"
+			userFlag = "test"
+			providerFlag = ""
+			kubeconfigFlag = ""
+			kubectlContextFlags = KubectlContext{Namespace: "kube-system"}
+			defer func() { kubectlContextFlags = KubectlContext{} }()
+			config.updateAlias(&newAliasConfig, fakeURL, map[string]bool{"namespace": true})
+			So(newAliasConfig.KubectlUser, ShouldEqual, "testuser")
+			So(newAliasConfig.Provider, ShouldEqual, "partners")
+			So(newAliasConfig.Kubeconfig, ShouldEqual, "/tmp/kubeconfig")
+			So(newAliasConfig.KubectlContext, ShouldResemble, KubectlContext{Cluster: "example", Namespace: "kube-system"})
+			So(newAliasConfig.RefreshToken, ShouldEqual, "refresh")
+		})
+		Convey("should drop the refresh token when the server changes", func() {
+			newAliasConfig.RefreshToken = "refresh"
+			otherURL, _ := url.Parse("https://other.example.com")
+			config.updateAlias(&newAliasConfig, otherURL, nil)
+			So(newAliasConfig.BaseURL, ShouldEqual, "https://other.example.com")
+			So(newAliasConfig.RefreshToken, ShouldEqual, "")
 		})
 	})
 }
 
 // Must search for User struct because slices have no guaranteed order
-func findUserStruct(y kubeYAML, p string) (bool, k8User) {
+func findUserStruct(doc *yaml.Node, p string) (bool, k8User) {
+	var y kubeYAML
+	if err := doc.Decode(&y); err != nil {
+		return false, k8User{}
+	}
 	for _, v := range y.Users {
 		if v.Name == p {
 			return true, v
@@ -220,12 +498,62 @@ func findUserStruct(y kubeYAML, p string) (bool, k8User) {
 }
 
 // Attempting to unmarshal a text string as YAML failed due to illegal characters
-func constructYaml() (kubeYAML, error) {
-	var kyaml kubeYAML
+func constructYaml() (*yaml.Node, error) {
 	tokenKube, err := ioutil.ReadFile("testdata.yml")
 	if err != nil {
-		return kyaml, err
+		return nil, err
 	}
-	err = yaml.Unmarshal(tokenKube, &kyaml)
-	return kyaml, err
+	return parseKubeconfig(tokenKube)
+}
+
+func TestCodeChallengeS256(t *testing.T) {
+	Convey("codeChallengeS256", t, func() {
+		Convey("should match the RFC 7636 appendix B example", func() {
+			So(codeChallengeS256("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"), ShouldEqual, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM")
+		})
+		Convey("should generate a different verifier every time", func() {
+			first, _ := newCodeVerifier()
+			second, _ := newCodeVerifier()
+			So(first, ShouldNotEqual, second)
+			So(len(first), ShouldBeGreaterThanOrEqualTo, 43)
+		})
+	})
+}
+
+func TestKubectlContext(t *testing.T) {
+	Convey("KubectlContext", t, func() {
+		Convey("should name the context after the cluster unless told otherwise", func() {
+			So(KubectlContext{Cluster: "example"}.contextName(), ShouldEqual, "example")
+			So(KubectlContext{Cluster: "example", Context: "prod"}.contextName(), ShouldEqual, "prod")
+		})
+		Convey("should accept an alias without any of it", func() {
+			So(KubectlContext{}.validate(), ShouldEqual, nil)
+		})
+		Convey("should reject settings that have nothing to apply to", func() {
+			So(KubectlContext{Server: "https://kubernetes.example.com"}.validate(), ShouldNotEqual, nil)
+			So(KubectlContext{Namespace: "team"}.validate(), ShouldNotEqual, nil)
+			So(KubectlContext{SetCurrentContext: true}.validate(), ShouldNotEqual, nil)
+		})
+		Convey("should reject a bad server URL or CA", func() {
+			So(KubectlContext{Cluster: "example", Server: "not a url"}.validate(), ShouldNotEqual, nil)
+			So(KubectlContext{Cluster: "example", CertificateAuthorityData: "not base64!"}.validate(), ShouldNotEqual, nil)
+		})
+		Convey("should be kept in the alias next to the other settings", func() {
+			dir, err := ioutil.TempDir("", "kubelogin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir) // nolint: errcheck
+			var app app
+			app.filenameWithPath = filepath.Join(dir, ".kubeloginrc.yaml")
+			kc := KubectlContext{Cluster: "example", Server: "https://kubernetes.example.com", SetCurrentContext: true}
+			var config Config
+			config.appendAlias(AliasConfig{Alias: "test", BaseURL: "unused", KubectlUser: "user", KubectlContext: kc})
+			So(config.writeToFile(app.filenameWithPath), ShouldEqual, nil)
+			written, _ := ioutil.ReadFile(app.filenameWithPath)
+			So(string(written), ShouldContainSubstring, "\n  cluster: example\n")
+			So(app.getConfigSettings("test"), ShouldEqual, nil)
+			So(app.kubectlContext, ShouldResemble, kc)
+		})
+	})
 }
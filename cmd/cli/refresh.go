@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// tokenResponse is what the kubelogin server returns from /exchange and /refresh when asked for JSON
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// Servers that predate refresh tokens answer with the bare JWT no matter what we ask for.
+func readTokenResponse(res *http.Response) (*tokenResponse, error) {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return &tokenResponse{Token: string(body)}, nil
+	}
+	var tokens tokenResponse
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, errors.Wrap(err, "failed to decode token response")
+	}
+	if tokens.Token == "" {
+		return nil, fmt.Errorf("token response did not contain a token")
+	}
+	return &tokens, nil
+}
+
+// Trades the alias's refresh token for a new JWT without involving the browser.
+func (app *app) refreshJWT() error {
+	form := url.Values{}
+	form.Set("refresh_token", app.refreshToken)
+	if app.provider != "" {
+		form.Set(providerField, app.provider)
+	}
+	req, err := http.NewRequest("POST", app.kubeloginServer+"/refresh", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("kubelogin server refused the refresh token: %s", res.Status)
+	}
+	tokens, err := readTokenResponse(res)
+	if err != nil {
+		return err
+	}
+	if err := app.saveToken(tokens.Token); err != nil {
+		return err
+	}
+	return app.saveRefreshToken(tokens.RefreshToken)
+}
+
+// Returns true if a new token was obtained using the stored refresh token. Any failure is logged and
+// left for the caller to fall back to the browser.
+func (app *app) refreshWithoutBrowser() bool {
+	if app.refreshToken == "" {
+		return false
+	}
+	if err := app.refreshJWT(); err != nil {
+		log.Printf("Could not refresh token, a browser login is needed: %v", err)
+		return false
+	}
+	return true
+}
+
+// Refresh tokens are kept per alias in the kubeloginrc file. Logins that don't use an alias have nowhere
+// to keep one, so it is dropped.
+func (app *app) saveRefreshToken(refreshToken string) error {
+	if refreshToken == "" || app.kubeloginAlias == "" || refreshToken == app.refreshToken {
+		return nil
+	}
+	err := editConfigFile(app.filenameWithPath, func(config *Config) error {
+		aliasConfig, ok := config.aliasSearch(app.kubeloginAlias)
+		if !ok {
+			return fmt.Errorf("could not find the alias '%s' to save the refresh token", app.kubeloginAlias)
+		}
+		aliasConfig.RefreshToken = refreshToken
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	app.refreshToken = refreshToken
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReadTokenResponse(t *testing.T) {
+	Convey("readTokenResponse", t, func() {
+		respond := func(contentType, body string) *http.Response {
+			recorder := httptest.NewRecorder()
+			recorder.Header().Set("Content-Type", contentType)
+			recorder.WriteString(body) // nolint: errcheck
+			return recorder.Result()
+		}
+		Convey("should read the bare JWT older servers send", func() {
+			tokens, err := readTokenResponse(respond("text/plain; charset=utf-8", "jwt"))
+			So(err, ShouldEqual, nil)
+			So(tokens.Token, ShouldEqual, "jwt")
+			So(tokens.RefreshToken, ShouldEqual, "")
+		})
+		Convey("should read the token and refresh token from JSON", func() {
+			tokens, err := readTokenResponse(respond("application/json", `{"token":"jwt","refresh_token":"refresh"}`))
+			So(err, ShouldEqual, nil)
+			So(tokens.Token, ShouldEqual, "jwt")
+			So(tokens.RefreshToken, ShouldEqual, "refresh")
+		})
+		Convey("should return an error for JSON without a token", func() {
+			_, err := readTokenResponse(respond("application/json", `{}`))
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestRefreshJWT(t *testing.T) {
+	Convey("refreshJWT", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		kubeconfig, _ := ioutil.ReadFile("testdata.yml")
+		var app app
+		app.kubectlConfigPaths = []string{filepath.Join(dir, "config")}
+		app.filenameWithPath = filepath.Join(dir, ".kubeloginrc.yaml")
+		So(ioutil.WriteFile(app.kubectlConfigPaths[0], kubeconfig, 0600), ShouldEqual, nil)
+		var config Config
+		config.appendAlias(AliasConfig{Alias: "test", BaseURL: "unused", KubectlUser: "nonprod_oidc", RefreshToken: "old"})
+		So(config.writeToFile(app.filenameWithPath), ShouldEqual, nil)
+		So(app.getConfigSettings("test"), ShouldEqual, nil)
+
+		var received, receivedProvider string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.PostFormValue("refresh_token")
+			receivedProvider = r.PostFormValue(providerField)
+			if received != "old" {
+				http.Error(w, "no", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"token":"refreshedToken","refresh_token":"new"}`)) // nolint: errcheck
+		}))
+		defer server.Close()
+		app.kubeloginServer = server.URL
+
+		Convey("should write the new token to the kube config and keep the new refresh token", func() {
+			So(app.refreshWithoutBrowser(), ShouldBeTrue)
+			So(received, ShouldEqual, "old")
+			written, _ := ioutil.ReadFile(app.kubectlConfigPaths[0])
+			So(string(written), ShouldContainSubstring, "refreshedToken")
+			rc, _ := ioutil.ReadFile(app.filenameWithPath)
+			So(strings.Contains(string(rc), "refresh-token: new"), ShouldBeTrue)
+		})
+		Convey("should refresh at the alias's provider", func() {
+			app.provider = "partners"
+			So(app.refreshWithoutBrowser(), ShouldBeTrue)
+			So(receivedProvider, ShouldEqual, "partners")
+		})
+		Convey("should report failure so the caller can fall back to the browser", func() {
+			app.refreshToken = "revoked"
+			So(app.refreshWithoutBrowser(), ShouldBeFalse)
+		})
+		Convey("should not try without a refresh token", func() {
+			app.refreshToken = ""
+			So(app.refreshWithoutBrowser(), ShouldBeFalse)
+			So(received, ShouldEqual, "")
+		})
+	})
+}
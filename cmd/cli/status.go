@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// the kubelogin server's defaults for USER_CLAIM and GROUPS_CLAIM
+const (
+	defaultUserClaim   = "email"
+	defaultGroupsClaim = "groups"
+)
+
+// tokenStatus is what status shows about the token of one alias. The claims are decoded from the JWT
+// without verifying it, which is fine for seeing what the cluster will be told.
+type tokenStatus struct {
+	Alias       string     `json:"alias,omitempty" yaml:"alias,omitempty"`
+	KubectlUser string     `json:"kubectl_user" yaml:"kubectl-user"`
+	Source      string     `json:"source,omitempty" yaml:"source,omitempty"`
+	User        string     `json:"user,omitempty" yaml:"user,omitempty"`
+	Groups      []string   `json:"groups,omitempty" yaml:"groups,omitempty"`
+	Issuer      string     `json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	Audience    []string   `json:"audience,omitempty" yaml:"audience,omitempty"`
+	IssuedAt    *time.Time `json:"issued_at,omitempty" yaml:"issued-at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty" yaml:"expires-at,omitempty"`
+	Remaining   string     `json:"remaining,omitempty" yaml:"remaining,omitempty"`
+	Expired     bool       `json:"expired" yaml:"expired"`
+	Error       string     `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// claims like aud and groups may hold a single string or a list of them
+func stringListClaim(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var list []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func timeClaim(claim interface{}) *time.Time {
+	seconds, ok := claim.(float64)
+	if !ok {
+		return nil
+	}
+	t := time.Unix(int64(seconds), 0)
+	return &t
+}
+
+// Fills in the status from the claims of the JWT as of now.
+func (status *tokenStatus) readClaims(jwt, userClaim, groupsClaim string, now time.Time) {
+	claims, err := decodeJWTPayload(jwt)
+	if err != nil {
+		status.Error = fmt.Sprintf("JWT could not be parsed: %v", err)
+		return
+	}
+	status.User, _ = claims[userClaim].(string)
+	status.Groups = stringListClaim(claims[groupsClaim])
+	status.Issuer, _ = claims["iss"].(string)
+	status.Audience = stringListClaim(claims["aud"])
+	status.IssuedAt = timeClaim(claims["iat"])
+	status.ExpiresAt = timeClaim(claims["exp"])
+	if status.ExpiresAt == nil {
+		status.Error = "JWT has no expiry"
+		return
+	}
+	remaining := status.ExpiresAt.Sub(now).Round(time.Second)
+	status.Expired = remaining <= 0
+	if !status.Expired {
+		status.Remaining = remaining.String()
+	}
+}
+
+// Looks for the token where login leaves it, falling back to where get-token caches it.
+func (app *app) tokenStatus(userClaim, groupsClaim string, now time.Time) tokenStatus {
+	status := tokenStatus{Alias: app.kubeloginAlias, KubectlUser: app.kubectlUser}
+	jwt, err := app.kubeconfigToken()
+	status.Source = "kubeconfig"
+	if err != nil {
+		if cached, cacheErr := app.readTokenCache(); cacheErr == nil && cached != "" {
+			jwt, err = cached, nil
+			status.Source = "token cache"
+		}
+	}
+	if err != nil {
+		status.Source = ""
+		status.Error = err.Error()
+		return status
+	}
+	status.readClaims(jwt, userClaim, groupsClaim, now)
+	return status
+}
+
+func writeStatuses(out io.Writer, statuses []tokenStatus, output string) error {
+	switch output {
+	case jsonOutput:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	case yamlOutput:
+		marshaled, err := yaml.Marshal(statuses)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(marshaled)
+		return err
+	case tableOutput, "":
+		table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "ALIAS\tKUBECTL USER\tUSER\tGROUPS\tEXPIRES\tSTATUS") // nolint: errcheck
+		for _, status := range statuses {
+			expires := ""
+			if status.ExpiresAt != nil {
+				expires = status.ExpiresAt.Local().Format(time.RFC3339)
+			}
+			state := status.Remaining + " left"
+			if status.Error != "" {
+				state = status.Error
+			} else if status.Expired {
+				state = "expired"
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", status.Alias, status.KubectlUser, status.User, strings.Join(status.Groups, ","), expires, state) // nolint: errcheck
+		}
+		return table.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q, use %s, %s or %s", output, tableOutput, jsonOutput, yamlOutput)
+	}
+}
+
+// Shows the token of each of the named aliases, or of every alias if none are named. Each alias is looked
+// up with its own kube config settings, as login would.
+func (app *app) aliasStatuses(aliases []string, kubeconfigFlag, envList, defaultKubeconfigPath, userClaim, groupsClaim string) ([]tokenStatus, error) {
+	if len(aliases) == 0 {
+		config, err := readConfigFile(app.filenameWithPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, aliasConfig := range config.Aliases {
+			aliases = append(aliases, aliasConfig.Alias)
+		}
+	}
+	now := time.Now()
+	var statuses []tokenStatus
+	for _, alias := range aliases {
+		aliasApp := *app
+		aliasApp.kubectlConfigPaths = nil
+		if err := aliasApp.getConfigSettings(alias); err != nil {
+			return nil, err
+		}
+		aliasApp.setKubeconfigPaths(kubeconfigFlag, envList, defaultKubeconfigPath)
+		statuses = append(statuses, aliasApp.tokenStatus(userClaim, groupsClaim, now))
+	}
+	return statuses, nil
+}
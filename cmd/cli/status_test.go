@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReadClaims(t *testing.T) {
+	Convey("readClaims", t, func() {
+		now := time.Unix(1500000000, 0)
+		Convey("should pick out the claims that matter for RBAC", func() {
+			var status tokenStatus
+			status.readClaims(fakeJWT(map[string]interface{}{
+				"email":  "someone@example.com",
+				"groups": []string{"admins", "devs"},
+				"iss":    "https://issuer.example.com",
+				"aud":    "kubelogin",
+				"iat":    1499996400,
+				"exp":    1500003600,
+			}), "email", "groups", now)
+			So(status.Error, ShouldEqual, "")
+			So(status.User, ShouldEqual, "someone@example.com")
+			So(status.Groups, ShouldResemble, []string{"admins", "devs"})
+			So(status.Issuer, ShouldEqual, "https://issuer.example.com")
+			So(status.Audience, ShouldResemble, []string{"kubelogin"})
+			So(status.IssuedAt.Unix(), ShouldEqual, 1499996400)
+			So(status.ExpiresAt.Unix(), ShouldEqual, 1500003600)
+			So(status.Remaining, ShouldEqual, "1h0m0s")
+			So(status.Expired, ShouldBeFalse)
+		})
+		Convey("should use the configured claims and say when the token has expired", func() {
+			var status tokenStatus
+			status.readClaims(fakeJWT(map[string]interface{}{"upn": "someone", "roles": "admins", "aud": []string{"a", "b"}, "exp": 1499999999}), "upn", "roles", now)
+			So(status.User, ShouldEqual, "someone")
+			So(status.Groups, ShouldResemble, []string{"admins"})
+			So(status.Audience, ShouldResemble, []string{"a", "b"})
+			So(status.Expired, ShouldBeTrue)
+			So(status.Remaining, ShouldEqual, "")
+		})
+		Convey("should report a token it can't read", func() {
+			var status tokenStatus
+			status.readClaims("garbage", "email", "groups", now)
+			So(status.Error, ShouldNotEqual, "")
+		})
+	})
+}
+
+func TestAliasStatuses(t *testing.T) {
+	Convey("aliasStatuses", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		kubeconfig := filepath.Join(dir, "config")
+		jwt := fakeJWT(map[string]interface{}{"email": "someone@example.com", "groups": []string{"admins"}, "exp": time.Now().Add(time.Hour).Unix()})
+		So(ioutil.WriteFile(kubeconfig, []byte("users:\n- name: prod_oidc\n  user:\n    token: "+jwt+"\n"), 0600), ShouldEqual, nil)
+		var app app
+		app.filenameWithPath = filepath.Join(dir, ".kubeloginrc.yaml")
+		app.tokenCacheDir = filepath.Join(dir, "cache")
+		var config Config
+		config.appendAlias(AliasConfig{Alias: "prod", BaseURL: "https://kubelogin.example.com", KubectlUser: "prod_oidc"})
+		config.appendAlias(AliasConfig{Alias: "exec", BaseURL: "https://kubelogin.example.com", KubectlUser: "exec_oidc"})
+		config.appendAlias(AliasConfig{Alias: "none", BaseURL: "https://kubelogin.example.com", KubectlUser: "none_oidc"})
+		So(config.writeToFile(app.filenameWithPath), ShouldEqual, nil)
+		cached := app
+		cached.kubeloginServer = "https://kubelogin.example.com"
+		cached.kubectlUser = "exec_oidc"
+		So(cached.writeTokenCache(jwt), ShouldEqual, nil)
+
+		Convey("should report every alias, from the kube config or the token cache", func() {
+			statuses, err := app.aliasStatuses(nil, "", kubeconfig, "", defaultUserClaim, defaultGroupsClaim)
+			So(err, ShouldEqual, nil)
+			So(len(statuses), ShouldEqual, 3)
+			So(statuses[0].Alias, ShouldEqual, "prod")
+			So(statuses[0].Source, ShouldEqual, "kubeconfig")
+			So(statuses[0].User, ShouldEqual, "someone@example.com")
+			So(statuses[1].Source, ShouldEqual, "token cache")
+			So(statuses[1].Groups, ShouldResemble, []string{"admins"})
+			So(statuses[2].Error, ShouldNotEqual, "")
+
+			var out bytes.Buffer
+			So(writeStatuses(&out, statuses, tableOutput), ShouldEqual, nil)
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			So(len(lines), ShouldEqual, 4)
+			So(lines[1], ShouldContainSubstring, "someone@example.com")
+			So(lines[1], ShouldContainSubstring, "left")
+			So(lines[3], ShouldContainSubstring, "not found")
+
+			out.Reset()
+			So(writeStatuses(&out, statuses, jsonOutput), ShouldEqual, nil)
+			var decoded []tokenStatus
+			So(json.Unmarshal(out.Bytes(), &decoded), ShouldEqual, nil)
+			So(decoded[0].User, ShouldEqual, "someone@example.com")
+
+			out.Reset()
+			So(writeStatuses(&out, statuses, yamlOutput), ShouldEqual, nil)
+			So(out.String(), ShouldContainSubstring, "user: someone@example.com")
+		})
+		Convey("should only report the named aliases", func() {
+			statuses, err := app.aliasStatuses([]string{"prod"}, kubeconfig, "", "", defaultUserClaim, defaultGroupsClaim)
+			So(err, ShouldEqual, nil)
+			So(len(statuses), ShouldEqual, 1)
+			_, err = app.aliasStatuses([]string{"nope"}, kubeconfig, "", "", defaultUserClaim, defaultGroupsClaim)
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("should reject an unknown output format", func() {
+			So(writeStatuses(ioutil.Discard, nil, "xml"), ShouldNotEqual, nil)
+		})
+	})
+}
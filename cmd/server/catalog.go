@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// catalogCluster is one cluster the operator publishes on /catalog, with the alias and kubectl user the
+// CLI should set up for it
+type catalogCluster struct {
+	Alias                    string `json:"alias"`
+	KubectlUser              string `json:"kubectl_user"`
+	Cluster                  string `json:"cluster"`
+	Server                   string `json:"server"`
+	CertificateAuthorityData string `json:"certificate_authority_data,omitempty"`
+	Context                  string `json:"context,omitempty"`
+	Namespace                string `json:"namespace,omitempty"`
+	Description              string `json:"description,omitempty"`
+	// named provider to log in to the cluster with, empty for the default one
+	Provider string `json:"provider,omitempty"`
+}
+
+// catalog is served as is on /catalog and read from CATALOG_FILE in the same format
+type catalog struct {
+	Clusters []catalogCluster `json:"clusters"`
+}
+
+func loadCatalog(catalogFile string) (*catalog, error) {
+	contents, err := ioutil.ReadFile(catalogFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseCatalog(contents)
+}
+
+// Checks the catalog up front so a mistake in it stops the server instead of breaking every import.
+func parseCatalog(contents []byte) (*catalog, error) {
+	var parsed catalog
+	if err := json.Unmarshal(contents, &parsed); err != nil {
+		return nil, err
+	}
+	aliases := map[string]bool{}
+	for _, cluster := range parsed.Clusters {
+		if cluster.Alias == "" || cluster.KubectlUser == "" || cluster.Cluster == "" || cluster.Server == "" {
+			return nil, fmt.Errorf("every cluster needs an alias, kubectl_user, cluster and server")
+		}
+		if aliases[cluster.Alias] {
+			return nil, fmt.Errorf("alias %q is used more than once", cluster.Alias)
+		}
+		aliases[cluster.Alias] = true
+		if _, err := url.ParseRequestURI(cluster.Server); err != nil {
+			return nil, fmt.Errorf("server of %q is not a valid URL: %v", cluster.Alias, err)
+		}
+		if _, err := base64.StdEncoding.DecodeString(cluster.CertificateAuthorityData); err != nil {
+			return nil, fmt.Errorf("certificate_authority_data of %q is not valid base64: %v", cluster.Alias, err)
+		}
+	}
+	return &parsed, nil
+}
+
+// hands the cluster catalog to `kubelogin config import`
+func (app *app) catalogHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if app.catalog == nil {
+		http.Error(writer, "This server does not publish a cluster catalog", http.StatusNotFound)
+		return
+	}
+	writeJSON(writer, http.StatusOK, app.catalog)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseCatalog(t *testing.T) {
+	Convey("parseCatalog", t, func() {
+		Convey("should read the clusters", func() {
+			parsed, err := parseCatalog([]byte(`{"clusters":[{"alias":"prod","kubectl_user":"prod_oidc","cluster":"prod","server":"https://kubernetes.example.com","certificate_authority_data":"Y2E="}]}`))
+			So(err, ShouldEqual, nil)
+			So(parsed.Clusters, ShouldResemble, []catalogCluster{{
+				Alias:                    "prod",
+				KubectlUser:              "prod_oidc",
+				Cluster:                  "prod",
+				Server:                   "https://kubernetes.example.com",
+				CertificateAuthorityData: "Y2E=",
+			}})
+		})
+		Convey("should reject a cluster missing its alias, user, name or server", func() {
+			_, err := parseCatalog([]byte(`{"clusters":[{"alias":"prod","kubectl_user":"prod_oidc","cluster":"prod"}]}`))
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("should reject an alias used twice", func() {
+			cluster := `{"alias":"prod","kubectl_user":"prod_oidc","cluster":"prod","server":"https://kubernetes.example.com"}`
+			_, err := parseCatalog([]byte(`{"clusters":[` + cluster + `,` + cluster + `]}`))
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("should reject a bad server URL or CA", func() {
+			_, err := parseCatalog([]byte(`{"clusters":[{"alias":"prod","kubectl_user":"prod_oidc","cluster":"prod","server":"kubernetes"}]}`))
+			So(err, ShouldNotEqual, nil)
+			_, err = parseCatalog([]byte(`{"clusters":[{"alias":"prod","kubectl_user":"prod_oidc","cluster":"prod","server":"https://kubernetes.example.com","certificate_authority_data":"!"}]}`))
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestCatalogHandler(t *testing.T) {
+	Convey("catalogHandler", t, func() {
+		app := setAppMemberFields(nil, &oidcClient{redirectURI: "https://kubelogin.example.com/callback"})
+		Convey("should say when there is no catalog", func() {
+			unitTestServer := httptest.NewServer(getMux(app, "/download"))
+			defer unitTestServer.Close()
+			response, err := http.Get(unitTestServer.URL + "/catalog")
+			So(err, ShouldEqual, nil)
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("should serve the catalog as JSON", func() {
+			app.catalog = &catalog{Clusters: []catalogCluster{{Alias: "prod", KubectlUser: "prod_oidc", Cluster: "prod", Server: "https://kubernetes.example.com"}}}
+			unitTestServer := httptest.NewServer(getMux(app, "/download"))
+			defer unitTestServer.Close()
+			response, err := http.Get(unitTestServer.URL + "/catalog")
+			So(err, ShouldEqual, nil)
+			defer response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			So(response.Header.Get("Content-Type"), ShouldEqual, "application/json")
+			var served catalog
+			So(json.NewDecoder(response.Body).Decode(&served), ShouldEqual, nil)
+			So(served, ShouldResemble, *app.catalog)
+		})
+	})
+}
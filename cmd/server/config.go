@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const redactedValue = "REDACTED"
+
+// provider names end up in URLs and environment variable names
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// serverConfig is everything the server is configured with. It is read from the YAML file given with
+// --config or CONFIG_FILE, and every environment variable that is set overrides the field it is named
+// after: the YAML key in upper case, e.g. LISTEN_PORT for listen_port. Fields tagged env:"-" can only be
+// set in the file.
+type serverConfig struct {
+	OIDCProviderURL string `yaml:"oidc_provider_url"`
+	ClientID        string `yaml:"client_id"`
+	ClientSecret    string `yaml:"client_secret"`
+	RedirectURL     string `yaml:"redirect_url"`
+	// field of the token endpoint response handed to the CLI as the JWT
+	TokenType     string `yaml:"token_type"`
+	GroupsClaim   string `yaml:"groups_claim"`
+	UserClaim     string `yaml:"user_claim"`
+	OfflineAccess bool   `yaml:"offline_access"`
+	// requested on login on top of openid and the claims
+	Scopes []string `yaml:"scopes"`
+	// more providers the CLI can pick by name, next to the default one above; a list of them doesn't fit in
+	// one variable, so only their client secrets come from the environment
+	Providers []providerConfig `yaml:"providers" env:"-"`
+
+	ListenPort    int    `yaml:"listen_port"`
+	HTTPSCertPath string `yaml:"https_cert_path"`
+	HTTPSKeyPath  string `yaml:"https_key_path"`
+	DownloadDir   string `yaml:"download_dir"`
+	CatalogFile   string `yaml:"catalog_file"`
+	// serve the TokenReview webhook for API servers, naming users and groups with the prefixes. The API
+	// servers have to send the bearer token, since anyone else could use the webhook to try out tokens.
+	TokenReview               bool   `yaml:"token_review"`
+	TokenReviewUsernamePrefix string `yaml:"token_review_username_prefix"`
+	TokenReviewGroupsPrefix   string `yaml:"token_review_groups_prefix"`
+	TokenReviewBearerToken    string `yaml:"token_review_bearer_token"`
+	// API audiences kubelogin's tokens are good for; when empty the API servers decide
+	TokenReviewAudiences []string `yaml:"token_review_audiences"`
+
+	StoreType               string        `yaml:"store_type"`
+	RedisAddr               string        `yaml:"redis_addr"`
+	RedisPassword           string        `yaml:"redis_password"`
+	RedisTTL                time.Duration `yaml:"redis_ttl"`
+	StoreEncryptionKeys     string        `yaml:"store_encryption_keys"`
+	StoreEncryptionKeysFile string        `yaml:"store_encryption_keys_file"`
+	LoginSessionTTL         time.Duration `yaml:"login_session_ttl"`
+	DeviceCodeTTL           time.Duration `yaml:"device_code_ttl"`
+	DevicePollInterval      time.Duration `yaml:"device_poll_interval"`
+}
+
+// providerConfig is one provider the server logs users in with. The default provider has no name. Named
+// providers take their redirect URL, token type and claims from the default one unless they set their own;
+// the login session remembers the provider, so they can all share the same callback.
+type providerConfig struct {
+	Name            string   `yaml:"name"`
+	OIDCProviderURL string   `yaml:"oidc_provider_url"`
+	ClientID        string   `yaml:"client_id"`
+	ClientSecret    string   `yaml:"client_secret"`
+	RedirectURL     string   `yaml:"redirect_url,omitempty"`
+	TokenType       string   `yaml:"token_type,omitempty"`
+	GroupsClaim     string   `yaml:"groups_claim,omitempty"`
+	UserClaim       string   `yaml:"user_claim,omitempty"`
+	OfflineAccess   bool     `yaml:"offline_access"`
+	Scopes          []string `yaml:"scopes,omitempty"`
+}
+
+// the environment variable holding a named provider's client secret, so it can come from a Kubernetes secret
+func providerSecretEnv(name string) string {
+	return "PROVIDER_" + strings.ToUpper(strings.Replace(name, "-", "_", -1)) + "_CLIENT_SECRET"
+}
+
+// configErrors lists every problem found in the configuration, so they can all be fixed in one go
+type configErrors []string
+
+func (errs configErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(errs, "\n  ")
+}
+
+func defaultServerConfig() serverConfig {
+	return serverConfig{
+		TokenType:          idTokenField,
+		GroupsClaim:        "groups",
+		UserClaim:          "email",
+		DownloadDir:        "/download",
+		StoreType:          redisStoreType,
+		RedisTTL:           10 * time.Second,
+		LoginSessionTTL:    5 * time.Minute,
+		DeviceCodeTTL:      10 * time.Minute,
+		DevicePollInterval: 5 * time.Second,
+	}
+}
+
+// Reads the config file, if there is one, over the defaults and applies the environment on top.
+func loadServerConfig(configFile string, lookupEnv func(string) (string, bool)) (*serverConfig, error) {
+	config := defaultServerConfig()
+	if configFile != "" {
+		contents, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(contents, &config); err != nil {
+			return nil, fmt.Errorf("could not parse config file %s: %v", configFile, err)
+		}
+	}
+	if err := config.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// the environment variable overriding a field, named after its YAML key, or empty if it has none
+func envName(field reflect.StructField) string {
+	if field.Tag.Get("env") == "-" {
+		return ""
+	}
+	return strings.ToUpper(strings.Split(field.Tag.Get("yaml"), ",")[0])
+}
+
+// Overrides each field whose environment variable is set. Empty variables count as unset, as they always have.
+func (config *serverConfig) applyEnv(lookupEnv func(string) (string, bool)) error {
+	var errs configErrors
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := envName(value.Type().Field(i))
+		if name == "" {
+			continue
+		}
+		env, ok := lookupEnv(name)
+		if !ok || env == "" {
+			continue
+		}
+		if err := setFromString(value.Field(i), env); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	for i := range config.Providers {
+		if secret, ok := lookupEnv(providerSecretEnv(config.Providers[i].Name)); ok && secret != "" {
+			config.Providers[i].ClientSecret = secret
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func setFromString(field reflect.Value, env string) error {
+	switch field.Interface().(type) {
+	case time.Duration:
+		duration, err := time.ParseDuration(env)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration, e.g. 10s or 1m30s", env)
+		}
+		field.SetInt(int64(duration))
+	case int:
+		number, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", env)
+		}
+		field.SetInt(int64(number))
+	case bool:
+		flag, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", env)
+		}
+		field.SetBool(flag)
+	case string:
+		field.SetString(env)
+	case []string:
+		var values []string
+		for _, value := range strings.Split(env, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// Returns the default provider followed by the named ones, with what they don't set taken from the default.
+func (config *serverConfig) providerConfigs() []providerConfig {
+	defaultProvider := providerConfig{
+		OIDCProviderURL: config.OIDCProviderURL,
+		ClientID:        config.ClientID,
+		ClientSecret:    config.ClientSecret,
+		RedirectURL:     config.RedirectURL,
+		TokenType:       config.TokenType,
+		GroupsClaim:     config.GroupsClaim,
+		UserClaim:       config.UserClaim,
+		OfflineAccess:   config.OfflineAccess,
+		Scopes:          config.Scopes,
+	}
+	providers := []providerConfig{defaultProvider}
+	for _, named := range config.Providers {
+		if named.RedirectURL == "" {
+			named.RedirectURL = defaultProvider.RedirectURL
+		}
+		if named.TokenType == "" {
+			named.TokenType = defaultProvider.TokenType
+		}
+		if named.GroupsClaim == "" {
+			named.GroupsClaim = defaultProvider.GroupsClaim
+		}
+		if named.UserClaim == "" {
+			named.UserClaim = defaultProvider.UserClaim
+		}
+		providers = append(providers, named)
+	}
+	return providers
+}
+
+// Checks the whole configuration, including the catalog and key files it points to, without contacting
+// the provider or the store. Every problem is reported, not just the first.
+func (config *serverConfig) validate() error {
+	var errs configErrors
+	problem := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	for _, required := range []struct{ name, value string }{
+		{"oidc_provider_url", config.OIDCProviderURL},
+		{"client_id", config.ClientID},
+		{"client_secret", config.ClientSecret},
+		{"redirect_url", config.RedirectURL},
+		{"https_cert_path", config.HTTPSCertPath},
+		{"https_key_path", config.HTTPSKeyPath},
+		{"token_type", config.TokenType},
+		{"groups_claim", config.GroupsClaim},
+		{"user_claim", config.UserClaim},
+	} {
+		if required.value == "" {
+			problem("%s (%s) is not set", required.name, strings.ToUpper(required.name))
+		}
+	}
+	names := map[string]bool{}
+	for _, provider := range config.providerConfigs() {
+		prefix := ""
+		// the default provider comes first, so a second one without a name is a named one missing its name
+		if provider.Name != "" || names[""] {
+			prefix = fmt.Sprintf("provider %q: ", provider.Name)
+			if !providerNamePattern.MatchString(provider.Name) {
+				problem("%sname must be lower case letters, digits and dashes", prefix)
+			}
+			if names[provider.Name] {
+				problem("%sname is used more than once", prefix)
+			}
+			for _, required := range []struct{ name, value string }{
+				{"oidc_provider_url", provider.OIDCProviderURL},
+				{"client_id", provider.ClientID},
+				{"client_secret", provider.ClientSecret},
+			} {
+				if required.value == "" {
+					problem("%s%s is not set", prefix, required.name)
+				}
+			}
+		}
+		names[provider.Name] = true
+		for _, address := range []struct{ name, value string }{
+			{"oidc_provider_url", provider.OIDCProviderURL},
+			{"redirect_url", provider.RedirectURL},
+		} {
+			if address.value == "" {
+				continue
+			}
+			if parsed, err := url.Parse(address.value); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+				problem("%s%s %q is not an absolute URL", prefix, address.name, address.value)
+			}
+		}
+	}
+	if config.ListenPort < 1 || config.ListenPort > 65535 {
+		problem("listen_port %d is not a valid port", config.ListenPort)
+	}
+	switch config.StoreType {
+	case redisStoreType:
+		if config.RedisAddr == "" {
+			problem("redis_addr (REDIS_ADDR) must be set for the redis store")
+		}
+		if config.RedisPassword == "" {
+			problem("redis_password (REDIS_PASSWORD) must be set for the redis store, supplied as a secret in Kubernetes")
+		}
+	case memoryStoreType:
+	default:
+		problem("unknown store_type %q, expected %s or %s", config.StoreType, redisStoreType, memoryStoreType)
+	}
+	for _, ttl := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"redis_ttl", config.RedisTTL},
+		{"login_session_ttl", config.LoginSessionTTL},
+		{"device_code_ttl", config.DeviceCodeTTL},
+	} {
+		if ttl.value <= 0 {
+			problem("%s must be a positive duration, e.g. 10s or 1m10s", ttl.name)
+		}
+	}
+	if !config.TokenReview && (config.TokenReviewUsernamePrefix != "" || config.TokenReviewGroupsPrefix != "" || config.TokenReviewBearerToken != "" || len(config.TokenReviewAudiences) > 0) {
+		problem("token_review_username_prefix, token_review_groups_prefix, token_review_bearer_token and token_review_audiences need token_review to be turned on")
+	}
+	if config.TokenReview && config.TokenReviewBearerToken == "" {
+		problem("token_review_bearer_token (TOKEN_REVIEW_BEARER_TOKEN) must be set for the API servers to authenticate to the webhook with")
+	}
+	if config.DevicePollInterval < time.Second {
+		problem("device_poll_interval must be at least 1s")
+	}
+	if _, err := loadEncryptionKeys(config.StoreEncryptionKeys, config.StoreEncryptionKeysFile); err != nil {
+		problem("store encryption keys: %v", err)
+	}
+	if config.CatalogFile != "" {
+		if published, err := loadCatalog(config.CatalogFile); err != nil {
+			problem("catalog_file %s: %v", config.CatalogFile, err)
+		} else {
+			for _, cluster := range published.Clusters {
+				if !names[cluster.Provider] {
+					problem("catalog_file %s: cluster %s uses the unknown provider %q", config.CatalogFile, cluster.Alias, cluster.Provider)
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// the configuration as --print-config shows it, with secrets hidden
+func (config serverConfig) redacted() serverConfig {
+	secrets := []*string{&config.ClientSecret, &config.RedisPassword, &config.StoreEncryptionKeys, &config.TokenReviewBearerToken}
+	config.Providers = append([]providerConfig(nil), config.Providers...)
+	for i := range config.Providers {
+		secrets = append(secrets, &config.Providers[i].ClientSecret)
+	}
+	for _, secret := range secrets {
+		if *secret != "" {
+			*secret = redactedValue
+		}
+	}
+	return config
+}
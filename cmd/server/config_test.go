@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestLoadServerConfig(t *testing.T) {
+	Convey("loadServerConfig", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		configFile := filepath.Join(dir, "config.yaml")
+		So(ioutil.WriteFile(configFile, []byte("client_id: from-file\nlisten_port: 8443\nredis_ttl: 30s\nstore_type: memory\n"), 0600), ShouldEqual, nil)
+		env := map[string]string{}
+		lookupEnv := func(name string) (string, bool) {
+			value, ok := env[name]
+			return value, ok
+		}
+		Convey("should read the file over the defaults", func() {
+			config, err := loadServerConfig(configFile, lookupEnv)
+			So(err, ShouldEqual, nil)
+			So(config.ClientID, ShouldEqual, "from-file")
+			So(config.ListenPort, ShouldEqual, 8443)
+			So(config.RedisTTL, ShouldEqual, 30*time.Second)
+			So(config.StoreType, ShouldEqual, memoryStoreType)
+			So(config.LoginSessionTTL, ShouldEqual, 5*time.Minute)
+			So(config.TokenType, ShouldEqual, idTokenField)
+		})
+		Convey("should let environment variables override the file, ignoring empty ones", func() {
+			env["CLIENT_ID"] = "from-env"
+			env["LISTEN_PORT"] = "9443"
+			env["OFFLINE_ACCESS"] = "true"
+			env["DEVICE_POLL_INTERVAL"] = "2s"
+			env["STORE_TYPE"] = ""
+			config, err := loadServerConfig(configFile, lookupEnv)
+			So(err, ShouldEqual, nil)
+			So(config.ClientID, ShouldEqual, "from-env")
+			So(config.ListenPort, ShouldEqual, 9443)
+			So(config.OfflineAccess, ShouldBeTrue)
+			So(config.DevicePollInterval, ShouldEqual, 2*time.Second)
+			So(config.StoreType, ShouldEqual, memoryStoreType)
+		})
+		Convey("should work from the environment alone", func() {
+			env["REDIRECT_URL"] = "https://kubelogin.example.com/callback"
+			config, err := loadServerConfig("", lookupEnv)
+			So(err, ShouldEqual, nil)
+			So(config.RedirectURL, ShouldEqual, "https://kubelogin.example.com/callback")
+			So(config.StoreType, ShouldEqual, redisStoreType)
+		})
+		Convey("should take the providers from the file only", func() {
+			So(ioutil.WriteFile(configFile, []byte("providers:\n- name: partners\n  client_id: partner-client\n"), 0600), ShouldEqual, nil)
+			env["PROVIDERS"] = "partners"
+			config, err := loadServerConfig(configFile, lookupEnv)
+			So(err, ShouldEqual, nil)
+			So(config.Providers, ShouldHaveLength, 1)
+			So(config.Providers[0].ClientID, ShouldEqual, "partner-client")
+		})
+		Convey("should report every environment variable it can't parse", func() {
+			env["LISTEN_PORT"] = "https"
+			env["REDIS_TTL"] = "ten seconds"
+			_, err := loadServerConfig(configFile, lookupEnv)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "LISTEN_PORT")
+			So(err.Error(), ShouldContainSubstring, "REDIS_TTL")
+		})
+		Convey("should refuse unknown keys in the file", func() {
+			So(ioutil.WriteFile(configFile, []byte("client_idd: typo\n"), 0600), ShouldEqual, nil)
+			_, err := loadServerConfig(configFile, lookupEnv)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestProviderConfigs(t *testing.T) {
+	Convey("providerConfigs", t, func() {
+		config := defaultServerConfig()
+		config.OIDCProviderURL = "https://provider.example.com"
+		config.ClientID = "client"
+		config.RedirectURL = "https://kubelogin.example.com/callback"
+		config.Providers = []providerConfig{{Name: "partners", ClientID: "partner-client", UserClaim: "sub", Scopes: []string{"profile"}}}
+		Convey("should put the default provider first and fill in what the named ones leave out", func() {
+			providers := config.providerConfigs()
+			So(providers, ShouldHaveLength, 2)
+			So(providers[0].Name, ShouldEqual, "")
+			So(providers[0].ClientID, ShouldEqual, "client")
+			So(providers[1].ClientID, ShouldEqual, "partner-client")
+			So(providers[1].RedirectURL, ShouldEqual, "https://kubelogin.example.com/callback")
+			So(providers[1].TokenType, ShouldEqual, idTokenField)
+			So(providers[1].GroupsClaim, ShouldEqual, "groups")
+			So(providers[1].UserClaim, ShouldEqual, "sub")
+			So(providers[1].Scopes, ShouldResemble, []string{"profile"})
+		})
+		Convey("should take a named provider's client secret from the environment", func() {
+			env := map[string]string{"PROVIDER_PARTNERS_CLIENT_SECRET": "from-env", "SCOPES": "profile, offline"}
+			So(config.applyEnv(func(name string) (string, bool) {
+				value, ok := env[name]
+				return value, ok
+			}), ShouldEqual, nil)
+			So(config.Providers[0].ClientSecret, ShouldEqual, "from-env")
+			So(config.Scopes, ShouldResemble, []string{"profile", "offline"})
+		})
+	})
+}
+
+func TestValidateServerConfig(t *testing.T) {
+	Convey("validate", t, func() {
+		config := defaultServerConfig()
+		config.OIDCProviderURL = "https://provider.example.com"
+		config.ClientID = "client"
+		config.ClientSecret = "secret"
+		config.RedirectURL = "https://kubelogin.example.com/callback"
+		config.HTTPSCertPath = "/tls/tls.crt"
+		config.HTTPSKeyPath = "/tls/tls.key"
+		config.ListenPort = 443
+		config.StoreType = memoryStoreType
+		Convey("should accept a complete configuration", func() {
+			So(config.validate(), ShouldEqual, nil)
+		})
+		Convey("should check the named providers and the providers the catalog uses", func() {
+			config.Providers = []providerConfig{
+				{Name: "partners", OIDCProviderURL: "https://partners.example.com", ClientID: "partner-client", ClientSecret: "secret"},
+				{Name: "Partners", OIDCProviderURL: "partners.example.com", ClientID: "other"},
+				{Name: "partners", OIDCProviderURL: "https://partners.example.com", ClientID: "again", ClientSecret: "secret"},
+			}
+			err := config.validate()
+			So(err, ShouldNotEqual, nil)
+			So(err.(configErrors), ShouldHaveLength, 4)
+			So(err.Error(), ShouldContainSubstring, `provider "Partners": name must be`)
+			So(err.Error(), ShouldContainSubstring, `provider "Partners": client_secret is not set`)
+			So(err.Error(), ShouldContainSubstring, `provider "Partners": oidc_provider_url "partners.example.com" is not an absolute URL`)
+			So(err.Error(), ShouldContainSubstring, `provider "partners": name is used more than once`)
+		})
+		Convey("should only take TokenReview settings with the webhook turned on", func() {
+			config.TokenReviewGroupsPrefix = "oidc:"
+			So(config.validate(), ShouldNotEqual, nil)
+			config.TokenReview = true
+			config.TokenReviewBearerToken = "apiserver-secret"
+			So(config.validate(), ShouldEqual, nil)
+		})
+		Convey("should want a bearer token for the TokenReview webhook", func() {
+			config.TokenReview = true
+			err := config.validate()
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "token_review_bearer_token")
+		})
+		Convey("should report every problem at once", func() {
+			config.ClientID = ""
+			config.RedirectURL = "kubelogin/callback"
+			config.ListenPort = 70000
+			config.StoreType = redisStoreType
+			config.DevicePollInterval = time.Millisecond
+			config.StoreEncryptionKeys = "bad"
+			config.CatalogFile = "/does/not/exist.json"
+			err := config.validate()
+			So(err, ShouldNotEqual, nil)
+			problems, ok := err.(configErrors)
+			So(ok, ShouldBeTrue)
+			So(problems, ShouldHaveLength, 8)
+			So(err.Error(), ShouldContainSubstring, "client_id (CLIENT_ID) is not set")
+			So(err.Error(), ShouldContainSubstring, "redirect_url")
+			So(err.Error(), ShouldContainSubstring, "listen_port 70000")
+			So(err.Error(), ShouldContainSubstring, "redis_addr")
+			So(err.Error(), ShouldContainSubstring, "redis_password")
+			So(err.Error(), ShouldContainSubstring, "device_poll_interval")
+			So(err.Error(), ShouldContainSubstring, "store encryption keys")
+			So(err.Error(), ShouldContainSubstring, "catalog_file")
+		})
+	})
+}
+
+func TestRedactedServerConfig(t *testing.T) {
+	Convey("redacted", t, func() {
+		config := defaultServerConfig()
+		config.ClientID = "client"
+		config.ClientSecret = "secret"
+		config.StoreEncryptionKeys = testEncryptionKey("k", 1)
+		config.TokenReviewBearerToken = "apiserver-secret"
+		config.Providers = []providerConfig{{Name: "partners", ClientSecret: "partner-secret"}}
+		Convey("should hide the secrets that are set and leave the rest", func() {
+			printed, err := yaml.Marshal(config.redacted())
+			So(err, ShouldEqual, nil)
+			So(string(printed), ShouldContainSubstring, "client_id: client\n")
+			So(string(printed), ShouldContainSubstring, "client_secret: "+redactedValue+"\n")
+			So(string(printed), ShouldContainSubstring, "store_encryption_keys: "+redactedValue+"\n")
+			So(string(printed), ShouldContainSubstring, "token_review_bearer_token: "+redactedValue+"\n")
+			So(string(printed), ShouldContainSubstring, "redis_password: \"\"\n")
+			So(string(printed), ShouldContainSubstring, "redis_ttl: 10s\n")
+			So(strings.Contains(string(printed), "secret\n"), ShouldBeFalse)
+			So(strings.Contains(string(printed), "partner-secret"), ShouldBeFalse)
+			So(config.ClientSecret, ShouldEqual, "secret")
+			So(config.Providers[0].ClientSecret, ShouldEqual, "partner-secret")
+		})
+	})
+}
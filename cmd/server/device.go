@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc"
+)
+
+// RFC 8628 device authorization grant, for machines where the browser can't reach the CLI on localhost
+const (
+	deviceCodeField       = "device_code"
+	userCodeField         = "user_code"
+	grantTypeField        = "grant_type"
+	grantTypeDevice       = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeKeyPrefix   = "device:"
+	deviceResultKeyPrefix = "device-result:"
+	devicePollKeyPrefix   = "device-poll:"
+	userCodeKeyPrefix     = "user-code:"
+	// consonants only, so user codes can't spell words and are hard to mistype
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+	// how much slow_down adds to the polling interval
+	slowDownIncrement = 5 * time.Second
+)
+
+// deviceGrantError is one of the error codes the token endpoint answers pending polls with
+type deviceGrantError string
+
+func (e deviceGrantError) Error() string {
+	return string(e)
+}
+
+const (
+	errAuthorizationPending deviceGrantError = "authorization_pending"
+	errSlowDown             deviceGrantError = "slow_down"
+	errAccessDenied         deviceGrantError = "access_denied"
+	errExpiredToken         deviceGrantError = "expired_token"
+	errUnsupportedGrantType deviceGrantError = "unsupported_grant_type"
+	errInvalidRequest       deviceGrantError = "invalid_request"
+)
+
+// deviceSession is stored under the device code while the user logs in on another machine. It is
+// never rewritten, the callback writes the outcome and the polls their timing under their own keys.
+type deviceSession struct {
+	ExpiresAt time.Time     `json:"expires_at"`
+	Interval  time.Duration `json:"interval"`
+}
+
+// devicePoll is when the CLI last polled and how long it has to wait, grown by every slow_down
+type devicePoll struct {
+	LastPoll time.Time     `json:"last_poll"`
+	Interval time.Duration `json:"interval"`
+}
+
+// deviceResult is what the callback leaves for the polling CLI
+type deviceResult struct {
+	JWT          string `json:"jwt,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Denied       bool   `json:"denied,omitempty"`
+}
+
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+var devicePage = template.Must(template.New("device").Parse(`<!doctype html><html><head><title>Kubelogin</title></head><body><h1>Kubelogin</h1>{{if .Message}}<p>{{.Message}}</p>{{end}}<form method="post" action="/device"><p>Enter the code shown by kubelogin on your terminal.</p><input name="user_code" value="{{.UserCode}}" autocomplete="off" autofocus> <button type="submit">Continue</button></form></body></html>`))
+
+var deviceDonePage = template.Must(template.New("deviceDone").Parse(`<!doctype html><html><head><title>Kubelogin</title></head><body><h1>Kubelogin</h1><p>Login complete. You can close this window and return to your terminal.</p></body></html>`))
+
+// formats random consonants as XXXX-XXXX
+func newUserCode() (string, error) {
+	code := make([]byte, 0, userCodeLength+1)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := 0; i < userCodeLength; i++ {
+		if i == userCodeLength/2 {
+			code = append(code, '-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code = append(code, userCodeAlphabet[n.Int64()])
+	}
+	return string(code), nil
+}
+
+// users may type the code in lower case, with or without the dash
+func normalizeUserCode(userCode string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(userCode))
+}
+
+// the page users type their code into lives on this server, which is where the redirect URL already points
+func (authClient *oidcClient) deviceVerificationURI() (string, error) {
+	verificationURL, err := url.Parse(authClient.redirectURI)
+	if err != nil {
+		return "", err
+	}
+	verificationURL.Path = "/device"
+	verificationURL.RawQuery = ""
+	return verificationURL.String(), nil
+}
+
+// deviceUserCode is what a user code leads to: the device login and the provider it goes to
+type deviceUserCode struct {
+	DeviceCode string `json:"device_code"`
+	Provider   string `json:"provider,omitempty"`
+}
+
+// issues a device code for the CLI to poll with and a user code for the user to type into /device
+func (ts *tokenStore) newDeviceAuthorization(interval time.Duration, provider string) (string, string, error) {
+	deviceCode, err := newRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	userCode, err := newUserCode()
+	if err != nil {
+		return "", "", err
+	}
+	session := deviceSession{ExpiresAt: time.Now().Add(ts.deviceTimeToLive), Interval: interval}
+	if err := ts.putValue(deviceCodeKeyPrefix+deviceCode, session, ts.deviceTimeToLive); err != nil {
+		return "", "", err
+	}
+	if err := ts.putValue(userCodeKeyPrefix+normalizeUserCode(userCode), deviceUserCode{DeviceCode: deviceCode, Provider: provider}, ts.deviceTimeToLive); err != nil {
+		return "", "", err
+	}
+	return deviceCode, userCode, nil
+}
+
+// a user code can only start one login; if that login is abandoned the CLI has to ask for a new code
+func (ts *tokenStore) takeUserCode(userCode string) (*deviceUserCode, error) {
+	var code deviceUserCode
+	err := ts.takeValue(userCodeKeyPrefix+normalizeUserCode(userCode), &code)
+	if err == errNotFound {
+		return nil, errExpiredToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+func (ts *tokenStore) finishDeviceAuthorization(deviceCode string, result deviceResult) error {
+	return ts.putValue(deviceResultKeyPrefix+deviceCode, result, ts.deviceTimeToLive)
+}
+
+// returns the tokens once the user has logged in, otherwise one of the deviceGrantErrors the CLI should act on.
+// The session is only read, so concurrent polls and a failed write of the poll timing can't lose the login.
+func (ts *tokenStore) pollDeviceAuthorization(deviceCode string) (*deviceResult, error) {
+	var result deviceResult
+	err := ts.takeValue(deviceResultKeyPrefix+deviceCode, &result)
+	if err == nil {
+		for _, key := range []string{deviceCodeKeyPrefix + deviceCode, devicePollKeyPrefix + deviceCode} {
+			if err := ts.deleteValue(key); err != nil {
+				log.Printf("Error deleting finished device session: %v", err)
+			}
+		}
+		if result.Denied {
+			return nil, errAccessDenied
+		}
+		return &result, nil
+	}
+	if err != errNotFound {
+		return nil, err
+	}
+
+	var session deviceSession
+	err = ts.getValue(deviceCodeKeyPrefix+deviceCode, &session)
+	if err == errNotFound {
+		return nil, errExpiredToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	remaining := time.Until(session.ExpiresAt)
+	if remaining <= 0 {
+		return nil, errExpiredToken
+	}
+	// the store won't overwrite a key, so the poll timing is taken and put back
+	poll := devicePoll{Interval: session.Interval}
+	if err := ts.takeValue(devicePollKeyPrefix+deviceCode, &poll); err != nil && err != errNotFound {
+		return nil, err
+	}
+	now := time.Now()
+	pollErr := errAuthorizationPending
+	if now.Sub(poll.LastPoll) < poll.Interval {
+		poll.Interval += slowDownIncrement
+		pollErr = errSlowDown
+	}
+	poll.LastPoll = now
+	if err := ts.putValue(devicePollKeyPrefix+deviceCode, poll, remaining); err != nil && err != errKeyExists {
+		log.Printf("Error recording device poll: %v", err)
+	}
+	return nil, pollErr
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		log.Printf("unable to write response: %v", err)
+	}
+}
+
+func writeDeviceGrantError(writer http.ResponseWriter, err deviceGrantError) {
+	writeJSON(writer, http.StatusBadRequest, map[string]string{errorField: string(err)})
+}
+
+// handles the CLI asking to start a device login
+func (app *app) deviceAuthorizationHandler(writer http.ResponseWriter, request *http.Request) {
+	cliToServerRequestCounter.Inc()
+	if request.Method != http.MethodPost {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	providerName := request.PostFormValue(providerField)
+	authClient, err := app.providerClient(providerName)
+	if err != nil {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	verificationURI, err := authClient.deviceVerificationURI()
+	if err != nil {
+		cliToServerErrorCounter.Inc()
+		log.Printf("Error building device verification URI: %v", err)
+		http.Error(writer, "Failed to start device login", http.StatusInternalServerError)
+		return
+	}
+	deviceCode, userCode, err := app.tokenStore.newDeviceAuthorization(app.devicePollInterval, providerName)
+	if err != nil {
+		cliToServerErrorCounter.Inc()
+		log.Printf("Error creating device authorization: %v", err)
+		http.Error(writer, "Failed to start device login", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(writer, http.StatusOK, deviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{userCodeField: {userCode}}.Encode(),
+		ExpiresIn:               int(app.tokenStore.deviceTimeToLive / time.Second),
+		Interval:                int(app.devicePollInterval / time.Second),
+	})
+}
+
+func renderDevicePage(writer http.ResponseWriter, status int, userCode, message string) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(status)
+	if err := devicePage.Execute(writer, struct{ UserCode, Message string }{userCode, message}); err != nil {
+		log.Printf("unable to write device page: %v", err)
+	}
+}
+
+// shows the user code form and, once a code is submitted, sends the user off to the OIDC provider.
+// A code in the URL only fills in the form so that a link alone can never start a login.
+func (app *app) deviceVerificationHandler(writer http.ResponseWriter, request *http.Request) {
+	userCode := request.FormValue(userCodeField)
+	if request.Method != http.MethodPost {
+		renderDevicePage(writer, http.StatusOK, userCode, "")
+		return
+	}
+	code, err := app.tokenStore.takeUserCode(userCode)
+	if err == errExpiredToken {
+		renderDevicePage(writer, http.StatusBadRequest, userCode, "That code is not valid. It may have expired or already been used.")
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up user code: %v", err)
+		renderErrorPage(writer, http.StatusInternalServerError, "The login could not be started.")
+		return
+	}
+	authClient, err := app.providerClient(code.Provider)
+	if err != nil {
+		log.Printf("Error looking up the provider of a user code: %v", err)
+		renderErrorPage(writer, http.StatusInternalServerError, "The login could not be started.")
+		return
+	}
+	state, session, err := app.tokenStore.startLoginSession(loginSession{DeviceCode: code.DeviceCode, Provider: code.Provider})
+	if err != nil {
+		log.Printf("Error creating login session: %v", err)
+		renderErrorPage(writer, http.StatusInternalServerError, "The login could not be started.")
+		return
+	}
+	authCodeURL := authClient.getOAuth2Config(authClient.loginScopes()).AuthCodeURL(state, oidc.Nonce(session.Nonce))
+	http.Redirect(writer, request, authCodeURL, http.StatusSeeOther)
+}
+
+// records the outcome of a login started from /device for the polling CLI and tells the user to head back
+func (app *app) finishDeviceLogin(writer http.ResponseWriter, deviceCode, jwt, refreshToken string, loginErr error) {
+	result := deviceResult{JWT: jwt, RefreshToken: refreshToken, Denied: loginErr != nil}
+	if err := app.tokenStore.finishDeviceAuthorization(deviceCode, result); err != nil {
+		serverToAuthErrorCounter.Inc()
+		log.Printf("Error storing device login result: %v", err)
+		renderErrorPage(writer, http.StatusInternalServerError, "The login could not be completed.")
+		return
+	}
+	if loginErr != nil {
+		serverToAuthErrorCounter.Inc()
+		log.Printf("Error in device login: %v", loginErr)
+		renderErrorPage(writer, http.StatusUnauthorized, "The login could not be completed.")
+		return
+	}
+	tokenCounter.Inc()
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := deviceDonePage.Execute(writer, nil); err != nil {
+		log.Printf("unable to write device page: %v", err)
+	}
+}
+
+// polled by the CLI until the user has finished logging in
+func (app *app) deviceTokenHandler(writer http.ResponseWriter, request *http.Request) {
+	cliToServerRequestCounter.Inc()
+	if request.Method != http.MethodPost {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if request.PostFormValue(grantTypeField) != grantTypeDevice {
+		cliToServerErrorCounter.Inc()
+		writeDeviceGrantError(writer, errUnsupportedGrantType)
+		return
+	}
+	deviceCode := request.PostFormValue(deviceCodeField)
+	if deviceCode == "" {
+		cliToServerErrorCounter.Inc()
+		writeDeviceGrantError(writer, errInvalidRequest)
+		return
+	}
+	result, err := app.tokenStore.pollDeviceAuthorization(deviceCode)
+	if grantErr, ok := err.(deviceGrantError); ok {
+		writeDeviceGrantError(writer, grantErr)
+		return
+	}
+	if err != nil {
+		cliToServerErrorCounter.Inc()
+		log.Printf("Error polling device authorization: %v", err)
+		http.Error(writer, "Failed to poll device login", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(writer, http.StatusOK, deviceTokenResponse{AccessToken: result.JWT, TokenType: "Bearer", RefreshToken: result.RefreshToken})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNewUserCode(t *testing.T) {
+	Convey("newUserCode", t, func() {
+		Convey("should return two groups of four consonants", func() {
+			userCode, err := newUserCode()
+			So(err, ShouldEqual, nil)
+			So(regexp.MustCompile(`^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$`).MatchString(userCode), ShouldBeTrue)
+		})
+	})
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	Convey("normalizeUserCode", t, func() {
+		Convey("should ignore case, dashes and spaces", func() {
+			So(normalizeUserCode("bcdf-ghjk"), ShouldEqual, "BCDFGHJK")
+			So(normalizeUserCode(" BCDF GHJK "), ShouldEqual, "BCDFGHJK")
+		})
+	})
+}
+
+func TestDeviceVerificationURI(t *testing.T) {
+	Convey("deviceVerificationURI", t, func() {
+		Convey("should point at /device on the host of the redirect URL", func() {
+			authClient := &oidcClient{redirectURI: "https://kubelogin.example.com/callback"}
+			verificationURI, err := authClient.deviceVerificationURI()
+			So(err, ShouldEqual, nil)
+			So(verificationURI, ShouldEqual, "https://kubelogin.example.com/device")
+		})
+	})
+}
+
+func TestDeviceHandlers(t *testing.T) {
+	Convey("device handlers", t, func() {
+		app := setAppMemberFields(nil, &oidcClient{redirectURI: "https://kubelogin.example.com/callback"})
+		unitTestServer := httptest.NewServer(getMux(app, "/download"))
+		defer unitTestServer.Close()
+		Convey("should only start a device login on POST", func() {
+			response, _ := http.Get(unitTestServer.URL + "/device/code")
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+		Convey("should refuse to poll with another grant type", func() {
+			response, err := http.PostForm(unitTestServer.URL+"/device/token", url.Values{grantTypeField: {"authorization_code"}, deviceCodeField: {"hoopla"}})
+			So(err, ShouldEqual, nil)
+			defer response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+			var body map[string]string
+			So(json.NewDecoder(response.Body).Decode(&body), ShouldEqual, nil)
+			So(body[errorField], ShouldEqual, "unsupported_grant_type")
+		})
+		Convey("should refuse to poll without a device code", func() {
+			response, err := http.PostForm(unitTestServer.URL+"/device/token", url.Values{grantTypeField: {grantTypeDevice}})
+			So(err, ShouldEqual, nil)
+			defer response.Body.Close() // nolint: errcheck
+			var body map[string]string
+			So(json.NewDecoder(response.Body).Decode(&body), ShouldEqual, nil)
+			So(body[errorField], ShouldEqual, "invalid_request")
+		})
+		Convey("should fill in the user code from the link without starting a login", func() {
+			response, err := http.Get(unitTestServer.URL + "/device?user_code=BCDF-GHJK")
+			So(err, ShouldEqual, nil)
+			defer response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			body, _ := ioutil.ReadAll(response.Body)
+			So(string(body), ShouldContainSubstring, `value="BCDF-GHJK"`)
+		})
+	})
+}
+
+func TestPollDeviceAuthorization(t *testing.T) {
+	Convey("pollDeviceAuthorization", t, func() {
+		redisTTL, _ := time.ParseDuration("10s")
+		ts := newTokenStore(newMemoryStore(), redisTTL, redisTTL)
+		ts.deviceTimeToLive = redisTTL
+		deviceCode, userCode, err := ts.newDeviceAuthorization(time.Hour, "partners")
+		So(err, ShouldEqual, nil)
+		Convey("should be pending until the user logs in, then hand out the token once", func() {
+			_, err := ts.pollDeviceAuthorization(deviceCode)
+			So(err, ShouldEqual, errAuthorizationPending)
+			taken, err := ts.takeUserCode(strings.ToLower(userCode))
+			So(err, ShouldEqual, nil)
+			So(taken.DeviceCode, ShouldEqual, deviceCode)
+			So(taken.Provider, ShouldEqual, "partners")
+			So(ts.finishDeviceAuthorization(deviceCode, deviceResult{JWT: "hoopla"}), ShouldEqual, nil)
+			result, err := ts.pollDeviceAuthorization(deviceCode)
+			So(err, ShouldEqual, nil)
+			So(result.JWT, ShouldEqual, "hoopla")
+			_, err = ts.pollDeviceAuthorization(deviceCode)
+			So(err, ShouldEqual, errExpiredToken)
+		})
+		Convey("should ask a CLI that polls too fast to slow down", func() {
+			_, err := ts.pollDeviceAuthorization(deviceCode)
+			So(err, ShouldEqual, errAuthorizationPending)
+			_, err = ts.pollDeviceAuthorization(deviceCode)
+			So(err, ShouldEqual, errSlowDown)
+		})
+		Convey("should keep the session while polls come in", func() {
+			_, err := ts.pollDeviceAuthorization(deviceCode)
+			So(err, ShouldEqual, errAuthorizationPending)
+			var session deviceSession
+			So(ts.getValue(deviceCodeKeyPrefix+deviceCode, &session), ShouldEqual, nil)
+			_, err = ts.pollDeviceAuthorization(deviceCode)
+			So(err, ShouldEqual, errSlowDown)
+			So(ts.getValue(deviceCodeKeyPrefix+deviceCode, &session), ShouldEqual, nil)
+		})
+		Convey("should only accept a user code once", func() {
+			_, err := ts.takeUserCode(userCode)
+			So(err, ShouldEqual, nil)
+			_, err = ts.takeUserCode(userCode)
+			So(err, ShouldEqual, errExpiredToken)
+		})
+		Convey("should report a failed login as access denied", func() {
+			So(ts.finishDeviceAuthorization(deviceCode, deviceResult{Denied: true}), ShouldEqual, nil)
+			_, err := ts.pollDeviceAuthorization(deviceCode)
+			So(err, ShouldEqual, errAccessDenied)
+		})
+	})
+}
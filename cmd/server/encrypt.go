@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// separates the key ID from the sealed value; key IDs may not contain it
+const keyIDSeparator = ':'
+
+// encryptionKey is one AES-GCM key of the key ring, known by an ID that is stored with every value it seals
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// encryptingStore seals values with AES-GCM before they reach the wrapped store, so the store only ever
+// holds ciphertext. The first key seals new values; the others are kept so values sealed before a rotation
+// can still be opened until they expire.
+type encryptingStore struct {
+	store Store
+	keys  []encryptionKey
+}
+
+func newEncryptingStore(store Store, keys []encryptionKey) *encryptingStore {
+	return &encryptingStore{store: store, keys: keys}
+}
+
+// reads the key ring from STORE_ENCRYPTION_KEYS or the file named by STORE_ENCRYPTION_KEYS_FILE. Either holds
+// entries of the form id:base64key separated by commas or new lines, the key sealing new values first.
+func loadEncryptionKeys(keysEnv, keysFile string) ([]encryptionKey, error) {
+	if keysEnv != "" && keysFile != "" {
+		return nil, fmt.Errorf("only one of STORE_ENCRYPTION_KEYS and STORE_ENCRYPTION_KEYS_FILE may be set")
+	}
+	if keysFile != "" {
+		contents, err := ioutil.ReadFile(keysFile)
+		if err != nil {
+			return nil, err
+		}
+		keysEnv = string(contents)
+	}
+	return parseEncryptionKeys(keysEnv)
+}
+
+func parseEncryptionKeys(spec string) ([]encryptionKey, error) {
+	var keys []encryptionKey
+	seen := map[string]bool{}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		separator := strings.IndexRune(entry, keyIDSeparator)
+		if separator <= 0 {
+			return nil, fmt.Errorf("encryption key entries must look like id:base64key")
+		}
+		id := entry[:separator]
+		if seen[id] {
+			return nil, fmt.Errorf("encryption key ID %q is used more than once", id)
+		}
+		seen[id] = true
+		secret, err := base64.StdEncoding.DecodeString(entry[separator+1:])
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q is not valid base64: %v", id, err)
+		}
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q must be 16, 24 or 32 bytes: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, encryptionKey{id: id, aead: aead})
+	}
+	return keys, nil
+}
+
+// the store key is authenticated along with the value, so ciphertext copied to another key won't open
+func (store *encryptingStore) seal(key string, value []byte) ([]byte, error) {
+	sealing := store.keys[0]
+	nonce := make([]byte, sealing.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := append([]byte(sealing.id), keyIDSeparator)
+	sealed = append(sealed, nonce...)
+	return sealing.aead.Seal(sealed, nonce, value, []byte(key)), nil
+}
+
+func (store *encryptingStore) open(key string, sealed []byte) ([]byte, error) {
+	separator := bytes.IndexByte(sealed, keyIDSeparator)
+	if separator <= 0 {
+		return nil, fmt.Errorf("stored value is not encrypted")
+	}
+	id := string(sealed[:separator])
+	for _, k := range store.keys {
+		if k.id != id {
+			continue
+		}
+		ciphertext := sealed[separator+1:]
+		if len(ciphertext) < k.aead.NonceSize() {
+			return nil, fmt.Errorf("stored value is too short")
+		}
+		nonce := ciphertext[:k.aead.NonceSize()]
+		return k.aead.Open(nil, nonce, ciphertext[k.aead.NonceSize():], []byte(key))
+	}
+	return nil, fmt.Errorf("stored value was encrypted with unknown key %q", id)
+}
+
+func (store *encryptingStore) Put(key string, value []byte, timeToLive time.Duration) error {
+	sealed, err := store.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return store.store.Put(key, sealed, timeToLive)
+}
+
+func (store *encryptingStore) Take(key string) ([]byte, error) {
+	sealed, err := store.store.Take(key)
+	if err != nil {
+		return nil, err
+	}
+	return store.open(key, sealed)
+}
+
+func (store *encryptingStore) Get(key string) ([]byte, error) {
+	sealed, err := store.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return store.open(key, sealed)
+}
+
+func (store *encryptingStore) Delete(key string) error {
+	return store.store.Delete(key)
+}
+
+func (store *encryptingStore) Ping() error {
+	return store.store.Ping()
+}
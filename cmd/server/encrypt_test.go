@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testEncryptionKey(id string, fill byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+}
+
+func TestParseEncryptionKeys(t *testing.T) {
+	Convey("parseEncryptionKeys", t, func() {
+		Convey("should read the keys in order", func() {
+			keys, err := parseEncryptionKeys(testEncryptionKey("new", 1) + ",\n" + testEncryptionKey("old", 2))
+			So(err, ShouldEqual, nil)
+			So(len(keys), ShouldEqual, 2)
+			So(keys[0].id, ShouldEqual, "new")
+			So(keys[1].id, ShouldEqual, "old")
+		})
+		Convey("should return no keys when none are configured", func() {
+			keys, err := parseEncryptionKeys("")
+			So(err, ShouldEqual, nil)
+			So(keys, ShouldBeEmpty)
+		})
+		Convey("should refuse an entry without an ID", func() {
+			_, err := parseEncryptionKeys(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("should refuse a key of the wrong size", func() {
+			_, err := parseEncryptionKeys("short:" + base64.StdEncoding.EncodeToString([]byte("hoopla")))
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("should refuse a repeated ID", func() {
+			_, err := parseEncryptionKeys(testEncryptionKey("same", 1) + "," + testEncryptionKey("same", 2))
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestLoadEncryptionKeys(t *testing.T) {
+	Convey("loadEncryptionKeys", t, func() {
+		dir, err := ioutil.TempDir("", "kubelogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		keysFile := filepath.Join(dir, "keys")
+		So(ioutil.WriteFile(keysFile, []byte(testEncryptionKey("file", 1)+"\n"), 0600), ShouldEqual, nil)
+		Convey("should read the keys from a file", func() {
+			keys, err := loadEncryptionKeys("", keysFile)
+			So(err, ShouldEqual, nil)
+			So(keys[0].id, ShouldEqual, "file")
+		})
+		Convey("should refuse keys from both the environment and a file", func() {
+			_, err := loadEncryptionKeys(testEncryptionKey("env", 1), keysFile)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestEncryptingStore(t *testing.T) {
+	Convey("encryptingStore", t, func() {
+		oldKeys, _ := parseEncryptionKeys(testEncryptionKey("old", 1))
+		rotatedKeys, _ := parseEncryptionKeys(testEncryptionKey("new", 2) + "," + testEncryptionKey("old", 1))
+		inner := newMemoryStore()
+		store := newEncryptingStore(inner, oldKeys)
+		Convey("should only hand ciphertext to the wrapped store", func() {
+			So(store.Put("key", []byte("hoopla"), time.Minute), ShouldEqual, nil)
+			So(bytes.Contains(inner.entries["key"].value, []byte("hoopla")), ShouldBeFalse)
+			value, err := store.Get("key")
+			So(err, ShouldEqual, nil)
+			So(string(value), ShouldEqual, "hoopla")
+			value, err = store.Take("key")
+			So(err, ShouldEqual, nil)
+			So(string(value), ShouldEqual, "hoopla")
+		})
+		Convey("should open values sealed before a key rotation and seal new ones with the new key", func() {
+			So(store.Put("key", []byte("hoopla"), time.Minute), ShouldEqual, nil)
+			rotated := newEncryptingStore(inner, rotatedKeys)
+			value, err := rotated.Take("key")
+			So(err, ShouldEqual, nil)
+			So(string(value), ShouldEqual, "hoopla")
+			So(rotated.Put("key", []byte("hoopla"), time.Minute), ShouldEqual, nil)
+			So(string(inner.entries["key"].value), ShouldStartWith, "new:")
+		})
+		Convey("should refuse a value sealed with a key that was removed", func() {
+			newKeys, _ := parseEncryptionKeys(testEncryptionKey("new", 2))
+			So(store.Put("key", []byte("hoopla"), time.Minute), ShouldEqual, nil)
+			_, err := newEncryptingStore(inner, newKeys).Take("key")
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("should refuse a value moved to another key", func() {
+			So(store.Put("key", []byte("hoopla"), time.Minute), ShouldEqual, nil)
+			sealed, _ := inner.Take("key")
+			So(inner.Put("other", sealed, time.Minute), ShouldEqual, nil)
+			_, err := store.Take("other")
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("should refuse a plaintext value", func() {
+			So(inner.Put("key", []byte("hoopla"), time.Minute), ShouldEqual, nil)
+			_, err := store.Take("key")
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("should pass not found through from the wrapped store", func() {
+			_, err := store.Take("missing")
+			So(err, ShouldEqual, errNotFound)
+		})
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	tokenTypeHintField = "token_type_hint"
+	idTokenHintField   = "id_token_hint"
+	clientIDField      = "client_id"
+)
+
+// providerLogoutEndpoints are the optional parts of the provider's discovery document used on logout
+type providerLogoutEndpoints struct {
+	RevocationEndpoint string `json:"revocation_endpoint"`
+	EndSessionEndpoint string `json:"end_session_endpoint"`
+}
+
+// logoutResponse tells the CLI whether the refresh token was revoked and where the user can end the
+// session with the provider, if it supports that
+type logoutResponse struct {
+	Revoked       bool   `json:"revoked"`
+	EndSessionURL string `json:"end_session_url,omitempty"`
+}
+
+// Providers that don't advertise an endpoint get an empty one; logout then does what it can without it.
+func (authClient *oidcClient) logoutEndpoints() providerLogoutEndpoints {
+	var endpoints providerLogoutEndpoints
+	if authClient.provider == nil {
+		return endpoints
+	}
+	if err := authClient.provider.Claims(&endpoints); err != nil {
+		log.Printf("Failed to read logout endpoints from the provider metadata. Error: %v", err)
+	}
+	return endpoints
+}
+
+// Revokes a refresh token as RFC 7009 describes, authenticating as the client.
+func (authClient *oidcClient) revokeRefreshToken(ctx context.Context, endpoint, refreshToken string) error {
+	form := url.Values{}
+	form.Set(tokenField, refreshToken)
+	form.Set(tokenTypeHintField, refreshTokenField)
+	request, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// RFC 6749 has the client credentials form encoded before they go into the basic auth header
+	request.SetBasicAuth(url.QueryEscape(authClient.clientID), url.QueryEscape(authClient.clientSecret))
+	client := authClient.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close() // nolint: errcheck
+	// a token that was already invalid is answered with 200 too
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("revocation endpoint returned %s", response.Status)
+	}
+	return nil
+}
+
+// the RP-initiated logout URL the user opens to end the session with the provider
+func (authClient *oidcClient) endSessionURL(endpoint, idToken string) (string, error) {
+	endSession, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	query := endSession.Query()
+	query.Set(clientIDField, authClient.clientID)
+	if idToken != "" {
+		query.Set(idTokenHintField, idToken)
+	}
+	endSession.RawQuery = query.Encode()
+	return endSession.String(), nil
+}
+
+// handles the CLI logging out. The refresh token is revoked at the provider when it has a revocation
+// endpoint, and the ID token is only used as a hint for ending the provider session. Both are only
+// accepted in a POST body so that they stay out of access logs.
+func (app *app) logoutHandler(writer http.ResponseWriter, request *http.Request) {
+	startTime := time.Now()
+	cliToServerRequestCounter.Inc()
+	if request.Method != http.MethodPost {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	refreshToken := request.PostFormValue(refreshTokenField)
+	idToken := request.PostFormValue(idTokenField)
+	authClient, err := app.providerClient(request.PostFormValue(providerField))
+	if err != nil {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	endpoints := authClient.logoutEndpoints()
+	var response logoutResponse
+	if refreshToken != "" && endpoints.RevocationEndpoint != "" {
+		serverToAuthRequestCounter.Inc()
+		if err := authClient.revokeRefreshToken(request.Context(), endpoints.RevocationEndpoint, refreshToken); err != nil {
+			serverToAuthErrorCounter.Inc()
+			log.Printf("Failed to revoke refresh token. Error: %v", err)
+			http.Error(writer, "Refresh token could not be revoked", http.StatusBadGateway)
+			return
+		}
+		response.Revoked = true
+	}
+	if endpoints.EndSessionEndpoint != "" {
+		endSessionURL, err := authClient.endSessionURL(endpoints.EndSessionEndpoint, idToken)
+		if err != nil {
+			log.Printf("Provider end_session_endpoint is invalid. Error: %v", err)
+		}
+		response.EndSessionURL = endSessionURL
+	}
+	writeJSON(writer, http.StatusOK, response)
+
+	elapsedTime := time.Since(startTime)
+	elapsedSec := elapsedTime / time.Second
+	serverResponseLatencies.WithLabelValues(request.Method).Observe(float64(elapsedSec))
+}
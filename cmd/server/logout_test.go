@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogoutHandler(t *testing.T) {
+	Convey("logoutHandler", t, func() {
+		tp := newTestProvider()
+		defer tp.server.Close()
+		authClient := newAuthClient("client", "secret", "redirect", tp.provider, "groups", "email")
+		app := setAppMemberFields(nil, authClient)
+		unitTestServer := httptest.NewServer(getMux(app, "/download"))
+		defer unitTestServer.Close()
+		logout := func(method string, form url.Values) *http.Response {
+			request, _ := http.NewRequest(method, unitTestServer.URL+"/logout", strings.NewReader(form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			response, _ := http.DefaultClient.Do(request)
+			return response
+		}
+		Convey("should revoke the refresh token and say where to end the provider session", func() {
+			response := logout("POST", url.Values{refreshTokenField: {"hoopla"}, idTokenField: {"jwt"}})
+			defer response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			var body logoutResponse
+			So(json.NewDecoder(response.Body).Decode(&body), ShouldEqual, nil)
+			So(body.Revoked, ShouldBeTrue)
+			So(tp.revokedTokens, ShouldResemble, []string{"hoopla"})
+			So(tp.revokingClient, ShouldEqual, "client")
+			endSession, err := url.Parse(body.EndSessionURL)
+			So(err, ShouldEqual, nil)
+			So(endSession.Path, ShouldEqual, "/logout")
+			So(endSession.Query().Get("ui"), ShouldEqual, "1")
+			So(endSession.Query().Get(idTokenHintField), ShouldEqual, "jwt")
+			So(endSession.Query().Get(clientIDField), ShouldEqual, "client")
+		})
+		Convey("should not call the provider without a refresh token", func() {
+			response := logout("POST", url.Values{})
+			defer response.Body.Close() // nolint: errcheck
+			var body logoutResponse
+			So(json.NewDecoder(response.Body).Decode(&body), ShouldEqual, nil)
+			So(body.Revoked, ShouldBeFalse)
+			So(body.EndSessionURL, ShouldNotEqual, "")
+			So(tp.revokedTokens, ShouldBeEmpty)
+		})
+		Convey("should not accept tokens in the URL", func() {
+			response := logout("GET", url.Values{})
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+	})
+}
@@ -2,31 +2,50 @@ package main
 
 import (
 	"context"
-	"crypto/sha1"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc"
-	"github.com/go-redis/redis"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/oauth2"
+	yaml "gopkg.in/yaml.v2"
 )
 
 type app struct {
-	redisValues *redisValues
-	authClient  *oidcClient
+	tokenStore *tokenStore
+	// the default provider, used when the CLI doesn't name one
+	authClient *oidcClient
+	// providers the CLI can pick by name
+	providers map[string]*oidcClient
+	// how often device logins may poll /device/token
+	devicePollInterval time.Duration
+	// clusters published on /catalog; nil when the operator hasn't set one up
+	catalog *catalog
+	// naming of users for the TokenReview webhook; nil when it is turned off
+	tokenReview *tokenReviewSettings
 }
 
-// struct that contains necessary oauth/oidc information
-type redisValues struct {
-	password   string
-	address    string
-	timeToLive time.Duration
-	client     *redis.Client
+// tokenStore keeps exchange tokens and login sessions in the configured Store, along with how long each may live
+type tokenStore struct {
+	store             Store
+	timeToLive        time.Duration
+	sessionTimeToLive time.Duration
+	deviceTimeToLive  time.Duration
 }
 
 type oidcClient struct {
@@ -38,6 +57,12 @@ type oidcClient struct {
 	client       *http.Client
 	groupsClaim  string
 	userClaim    string
+	// when set, offline_access is requested so the CLI can be handed a refresh token
+	offlineAccess bool
+	// field of the token endpoint response handed to the CLI as the JWT
+	tokenType string
+	// requested on login on top of openid and the claims
+	extraScopes []string
 }
 
 const (
@@ -49,9 +74,68 @@ const (
 	usernameField    = "username"
 	authCodeField    = "code"
 	tokenField       = "token"
+	errorField       = "error"
+	errorDescField   = "error_description"
+	manualField      = "manual"
+	providerField    = "provider"
+
+	// echoed back to the CLI's callback listener so it can tell the redirect for its own login apart
+	callbackSecretField     = "callback_secret"
+	maxCallbackSecretLength = 128
+	randomTokenSize         = 32
+	// the loopback address the CLI's callback listener bound to, sent along with the port. CLIs that don't
+	// send it listen on cliLoopbackHost; localhost is never used as it may resolve to the other address first.
+	hostField       = "host"
+	cliLoopbackHost = "127.0.0.1"
+
+	codeChallengeField       = "code_challenge"
+	codeChallengeMethodField = "code_challenge_method"
+	codeVerifierField        = "code_verifier"
+	codeChallengeMethodS256  = "S256"
+	// base64url without padding of a SHA-256 sum
+	codeChallengeLength = 43
+
+	// keys are namespaced so a value can never be redeemed through the wrong endpoint
+	exchangeKeyPrefix     = "exchange:"
+	loginSessionKeyPrefix = "state:"
 )
 
+// loginSession is stored under the opaque OAuth2 state between /login and /callback
+type loginSession struct {
+	Port           string `json:"port"`
+	Host           string `json:"host,omitempty"`
+	CodeChallenge  string `json:"code_challenge"`
+	Nonce          string `json:"nonce"`
+	CallbackSecret string `json:"callback_secret,omitempty"`
+	// set instead of the port when the login was started from /device
+	DeviceCode string `json:"device_code,omitempty"`
+	// set instead of the port when the user copies the exchange token into the CLI by hand
+	Manual bool `json:"manual,omitempty"`
+	// named provider the login went to, empty for the default one
+	Provider string `json:"provider,omitempty"`
+}
+
+// pendingExchange is what gets stored against an exchange token until the CLI redeems it
+type pendingExchange struct {
+	JWT           string `json:"jwt"`
+	RefreshToken  string `json:"refresh_token,omitempty"`
+	CodeChallenge string `json:"code_challenge"`
+}
+
+// tokenResponse is the JSON body handed to CLIs that ask for application/json on /exchange and /refresh
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
 var (
+	errNotFound        = errors.New("value not found in store")
+	errTokenNotFound   = errors.New("token not found, it may have expired or already been exchanged")
+	errUnknownState    = errors.New("state not found, it may have expired or already been used")
+	errNonceMismatch   = errors.New("nonce in the id token does not match the login session")
+	errBadVerifier     = errors.New("code verifier does not match the code challenge")
+	errUnknownProvider = errors.New("unknown provider")
+
 	cliToServerErrorCounter = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "kubelogin_cliToServerErrors_total",
 		Help: "number of times an error occurs",
@@ -68,6 +152,10 @@ var (
 		Name: "kubelogin_ServerToAuthRequests_total",
 		Help: "number of times the server returns a full jwt successfully",
 	})
+	exchangeReplayCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kubelogin_exchangeReplays_total",
+		Help: "number of times the cli presents a token that was already exchanged, has expired or was never issued",
+	})
 	tokenCounter = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "kubelogin_tokens_generated_total",
 		Help: "number of times the server generates a token to go into redis",
@@ -79,14 +167,6 @@ var (
 		[]string{"method"})
 )
 
-func getEnvOrDefault(envVar, defaultVal string) string {
-	val := defaultVal
-	if os.Getenv(envVar) != "" {
-		val = os.Getenv(envVar)
-	}
-	return val
-}
-
 // the config for oauth2, scopes contain info we want back from the auth server
 func (authClient *oidcClient) getOAuth2Config(scopes []string) *oauth2.Config {
 	return &oauth2.Config{
@@ -98,10 +178,11 @@ func (authClient *oidcClient) getOAuth2Config(scopes []string) *oauth2.Config {
 	}
 }
 
-// used to grab fields from HTTP requests
+// used to grab fields from HTTP requests. Only the name is logged: codes, states and exchange tokens can
+// be redeemed by whoever reads them.
 func getField(request *http.Request, fieldName string) string {
 	if request.FormValue(fieldName) != "" {
-		log.Printf("%s: [%s]", fieldName, request.FormValue(fieldName))
+		log.Printf("Received field [%s]", fieldName)
 		return request.FormValue(fieldName)
 	}
 	return ""
@@ -112,14 +193,56 @@ func getField(request *http.Request, fieldName string) string {
 func (app *app) handleCLILogin(writer http.ResponseWriter, request *http.Request) {
 	startTime := time.Now()
 	cliToServerRequestCounter.Inc()
+	manual := request.FormValue(manualField) == "true"
 	portState := request.FormValue(portField)
-	if portState == "" {
+	if portState == "" && !manual {
 		cliToServerErrorCounter.Inc()
 		http.Error(writer, "No return port in URL", http.StatusBadRequest)
 		return
 	}
-	var scopes = []string{"openid", app.authClient.groupsClaim, app.authClient.userClaim}
-	authCodeURL := app.authClient.getOAuth2Config(scopes).AuthCodeURL(portState)
+	codeChallenge := request.FormValue(codeChallengeField)
+	if err := validateCodeChallenge(codeChallenge, request.FormValue(codeChallengeMethodField)); err != nil {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := strconv.ParseUint(portState, 10, 16); err != nil && !manual {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, "Invalid return port in URL", http.StatusBadRequest)
+		return
+	}
+	host := request.FormValue(hostField)
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsLoopback()) {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, "Invalid "+hostField+" in URL, expected a loopback address", http.StatusBadRequest)
+		return
+	}
+	// CLIs from before the callback secret don't send one and get a redirect without it
+	callbackSecret := request.FormValue(callbackSecretField)
+	if len(callbackSecret) > maxCallbackSecretLength {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, "Invalid "+callbackSecretField+" in URL", http.StatusBadRequest)
+		return
+	}
+	// the provider is picked with /login/NAME or the provider parameter
+	providerName := strings.TrimPrefix(request.URL.Path, "/login/")
+	if providerName == request.URL.Path {
+		providerName = request.FormValue(providerField)
+	}
+	authClient, err := app.providerClient(providerName)
+	if err != nil {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state, session, err := app.tokenStore.startLoginSession(loginSession{Port: portState, Host: host, CodeChallenge: codeChallenge, CallbackSecret: callbackSecret, Manual: manual, Provider: providerName})
+	if err != nil {
+		cliToServerErrorCounter.Inc()
+		log.Printf("Error creating login session: %v", err)
+		http.Error(writer, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	authCodeURL := authClient.getOAuth2Config(authClient.loginScopes()).AuthCodeURL(state, oidc.Nonce(session.Nonce))
 
 	http.Redirect(writer, request, authCodeURL, http.StatusSeeOther)
 
@@ -128,7 +251,17 @@ func (app *app) handleCLILogin(writer http.ResponseWriter, request *http.Request
 	serverResponseLatencies.WithLabelValues(request.Method).Observe(float64(elapsedSec))
 }
 
-func (authClient *oidcClient) initiateAuthorization(requestContext context.Context, authCode string) (string, error) {
+func (authClient *oidcClient) loginScopes() []string {
+	scopes := []string{"openid", authClient.groupsClaim, authClient.userClaim}
+	scopes = append(scopes, authClient.extraScopes...)
+	if authClient.offlineAccess {
+		scopes = append(scopes, oidc.ScopeOfflineAccess)
+	}
+	return scopes
+}
+
+// exchanges the auth code and returns the JWT for the CLI along with the refresh token, if the provider issued one
+func (authClient *oidcClient) initiateAuthorization(requestContext context.Context, authCode string, nonce string) (string, string, error) {
 	var (
 		err   error
 		token *oauth2.Token
@@ -138,20 +271,63 @@ func (authClient *oidcClient) initiateAuthorization(requestContext context.Conte
 	token, err = authClient.getOAuth2Config(nil).Exchange(oidcClientContext, authCode)
 	if err != nil {
 		log.Printf("Failed to exchange token. Error: %v", err)
-		return "", err
+		return "", "", err
+	}
+	jwt, err := authClient.jwtFromToken(oidcClientContext, token, nonce)
+	if err != nil {
+		return "", "", err
 	}
+	return jwt, token.RefreshToken, nil
+}
 
-	fieldName := getEnvOrDefault("TOKEN_TYPE", idTokenField)
-	log.Printf("Using [%s] as the JWT", fieldName)
+// verifies the ID token in the token endpoint response and picks out the field configured to be handed to the CLI
+func (authClient *oidcClient) jwtFromToken(ctx context.Context, token *oauth2.Token, nonce string) (string, error) {
+	// the ID token is always verified, even when another field is handed to the CLI
+	rawIDToken, _ := token.Extra(idTokenField).(string)
+	who, err := authClient.verifyIDToken(ctx, rawIDToken, nonce)
+	if err != nil {
+		log.Printf("Failed to verify ID token. Error: %v", err)
+		return "", err
+	}
+	logIdentity(who)
 
-	rawIDToken, exists := token.Extra(fieldName).(string)
+	jwt, exists := token.Extra(authClient.tokenType).(string)
 	if !exists {
-		errMsg := fmt.Sprintf("field [%s] not found in token", fieldName)
+		errMsg := fmt.Sprintf("field [%s] not found in token", authClient.tokenType)
 		log.Printf(errMsg)
 		return "", fmt.Errorf(errMsg)
 	}
 
-	return rawIDToken, nil
+	return jwt, nil
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!doctype html><html><head><title>Kubelogin</title></head><body><h1>Kubelogin</h1><p>{{.}}</p><p>Please run kubelogin login again.</p></body></html>`))
+
+var manualCodePage = template.Must(template.New("manual").Parse(`<!doctype html><html><head><title>Kubelogin</title></head><body><h1>Kubelogin</h1><p>Copy this code and paste it into kubelogin on your terminal:</p><pre>{{.}}</pre><p>It can only be used once, by the kubelogin that started this login.</p></body></html>`))
+
+// the exchange token is still bound to the CLI's code challenge, so showing it to the user gives away nothing
+// the CLI doesn't also need. It lives as long as the login session since it has to be copied by hand.
+func (app *app) showManualCode(writer http.ResponseWriter, exchange pendingExchange) {
+	token, err := app.tokenStore.generateToken(exchange, app.tokenStore.sessionTimeToLive)
+	if err != nil {
+		cliToServerErrorCounter.Inc()
+		renderErrorPage(writer, http.StatusInternalServerError, "The login could not be completed.")
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	if err := manualCodePage.Execute(writer, token); err != nil {
+		log.Printf("unable to write manual code page: %v", err)
+	}
+}
+
+// writes a page the user can read in their browser instead of a bare status line
+func renderErrorPage(writer http.ResponseWriter, status int, message string) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(status)
+	if err := errorPage.Execute(writer, message); err != nil {
+		log.Printf("unable to write error page: %v", err)
+	}
 }
 
 // handles the callback from the auth server, exchanges the authcode, clientID, clientSecret for a rawToken which holds an id_token
@@ -160,15 +336,49 @@ func (app *app) callbackHandler(writer http.ResponseWriter, request *http.Reques
 	startTime := time.Now()
 	serverToAuthRequestCounter.Inc()
 
+	if authError := getField(request, errorField); authError != "" {
+		serverToAuthErrorCounter.Inc()
+		renderErrorPage(writer, http.StatusBadRequest, fmt.Sprintf("Login was refused by the identity provider: %s %s", authError, request.FormValue(errorDescField)))
+		return
+	}
 	authCode := getField(request, authCodeField)
-	port := getField(request, stateField)
-	if authCode == "" || port == "" {
+	state := getField(request, stateField)
+	if authCode == "" || state == "" {
+		serverToAuthErrorCounter.Inc()
+		log.Printf("Error! Need authcode and state. Received this authcode: [%s] | Received this state: [%s]", authCode, state)
+		renderErrorPage(writer, http.StatusBadRequest, "The login response is missing its code or state.")
+		return
+	}
+	session, err := app.tokenStore.takeLoginSession(state)
+	if err == errUnknownState {
+		serverToAuthErrorCounter.Inc()
+		log.Printf("Error! Unknown or reused state: [%s]", state)
+		renderErrorPage(writer, http.StatusBadRequest, "This login has expired or was already completed.")
+		return
+	}
+	if err != nil {
 		serverToAuthErrorCounter.Inc()
-		log.Printf("Error! Need authcode and port. Received this authcode: [%s] | Received this port: [%s]", authCode, port)
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Printf("Error looking up login session: %v", err)
+		renderErrorPage(writer, http.StatusInternalServerError, "The login could not be completed.")
+		return
+	}
+	authClient, err := app.providerClient(session.Provider)
+	if err != nil {
+		serverToAuthErrorCounter.Inc()
+		log.Printf("Error! Login session for provider [%s]: %v", session.Provider, err)
+		renderErrorPage(writer, http.StatusInternalServerError, "The login could not be completed.")
+		return
+	}
+	jwt, refreshToken, err := authClient.initiateAuthorization(request.Context(), authCode, session.Nonce)
+	if session.DeviceCode != "" {
+		app.finishDeviceLogin(writer, session.DeviceCode, jwt, refreshToken, err)
+		return
+	}
+	if _, refused := err.(*tokenVerificationError); refused {
+		serverToAuthErrorCounter.Inc()
+		renderErrorPage(writer, http.StatusUnauthorized, "The identity provider returned a token that could not be verified.")
 		return
 	}
-	jwt, err := app.authClient.initiateAuthorization(request.Context(), authCode)
 	if err != nil {
 		serverToAuthErrorCounter.Inc()
 		log.Print("Error in auth: " + err.Error())
@@ -176,7 +386,12 @@ func (app *app) callbackHandler(writer http.ResponseWriter, request *http.Reques
 		return
 	}
 
-	sendBackURL, err := app.redisValues.generateSendBackURL(jwt, port)
+	exchange := pendingExchange{JWT: jwt, RefreshToken: refreshToken, CodeChallenge: session.CodeChallenge}
+	if session.Manual {
+		app.showManualCode(writer, exchange)
+		return
+	}
+	sendBackURL, err := app.tokenStore.generateSendBackURL(exchange, session.Host, session.Port, session.CallbackSecret)
 	if err != nil {
 		cliToServerErrorCounter.Inc()
 		http.Error(writer, "Failed to generate send back url", http.StatusInternalServerError)
@@ -189,27 +404,124 @@ func (app *app) callbackHandler(writer http.ResponseWriter, request *http.Reques
 	serverResponseLatencies.WithLabelValues(request.Method).Observe(float64(elapsedSec))
 }
 
-func (rv *redisValues) fetchJWTForToken(token string) (string, error) {
-	jwt, err := rv.client.Get(token).Result()
+// only S256 is accepted; the plain method would put the verifier itself in the browser history
+func validateCodeChallenge(codeChallenge, method string) error {
+	if method != codeChallengeMethodS256 {
+		return fmt.Errorf("Unsupported %s [%s], only %s is accepted", codeChallengeMethodField, method, codeChallengeMethodS256)
+	}
+	if len(codeChallenge) != codeChallengeLength {
+		return fmt.Errorf("Invalid %s in URL", codeChallengeField)
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(codeChallenge); err != nil {
+		return fmt.Errorf("Invalid %s in URL", codeChallengeField)
+	}
+	return nil
+}
+
+// stores the value as JSON under the key, refusing to overwrite a key that is already in use
+func (ts *tokenStore) putValue(key string, value interface{}, timeToLive time.Duration) error {
+	encoded, err := json.Marshal(value)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return jwt, nil
+	return ts.store.Put(key, encoded, timeToLive)
+}
+
+// fetches and deletes the value in one step so that it can only ever be read once
+func (ts *tokenStore) takeValue(key string, value interface{}) error {
+	encoded, err := ts.store.Take(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, value)
+}
+
+// reads the value and leaves it for later requests
+func (ts *tokenStore) getValue(key string, value interface{}) error {
+	encoded, err := ts.store.Get(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, value)
+}
+
+func (ts *tokenStore) deleteValue(key string) error {
+	return ts.store.Delete(key)
+}
+
+// the state is opaque to everyone but this server; the port and nonce it stands for never leave the store
+func (ts *tokenStore) startLoginSession(session loginSession) (string, loginSession, error) {
+	state, err := newRandomToken()
+	if err != nil {
+		return "", session, err
+	}
+	if session.Nonce, err = newRandomToken(); err != nil {
+		return "", session, err
+	}
+	if err := ts.putValue(loginSessionKeyPrefix+state, session, ts.sessionTimeToLive); err != nil {
+		return "", session, err
+	}
+	return state, session, nil
+}
+
+func (ts *tokenStore) takeLoginSession(state string) (*loginSession, error) {
+	var session loginSession
+	err := ts.takeValue(loginSessionKeyPrefix+state, &session)
+	if err == errNotFound {
+		return nil, errUnknownState
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// checks the code verifier sent to /exchange against the challenge sent to /login
+func (exchange *pendingExchange) verify(codeVerifier string) error {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(exchange.CodeChallenge)) != 1 {
+		return errBadVerifier
+	}
+	return nil
+}
+
+// fetches and deletes the pending exchange so that a token can only ever be exchanged once
+func (ts *tokenStore) fetchExchangeForToken(token string) (*pendingExchange, error) {
+	var exchange pendingExchange
+	err := ts.takeValue(exchangeKeyPrefix+token, &exchange)
+	if err == errNotFound {
+		return nil, errTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &exchange, nil
 }
 
 func (app *app) exchangeHandler(writer http.ResponseWriter, request *http.Request) {
 	cliToServerRequestCounter.Inc()
 	startTime := time.Now()
 	token := getField(request, tokenField)
-	jwt, err := app.redisValues.fetchJWTForToken(token)
+	exchange, err := app.tokenStore.fetchExchangeForToken(token)
+	if err == errTokenNotFound {
+		exchangeReplayCounter.Inc()
+	}
 	if err != nil {
 		cliToServerErrorCounter.Inc()
 		log.Printf("Error exchanging token for JWT: %v", err)
 		http.Error(writer, "Invalid token", http.StatusUnauthorized)
 		return
 	}
+	// the token has already been consumed at this point, so a wrong guess burns it for good
+	if err := exchange.verify(request.FormValue(codeVerifierField)); err != nil {
+		cliToServerErrorCounter.Inc()
+		log.Printf("Error exchanging token for JWT: %v", err)
+		http.Error(writer, "Invalid code verifier", http.StatusUnauthorized)
+		return
+	}
 
-	_, e := writer.Write([]byte(jwt))
+	e := writeToken(writer, request, tokenResponse{Token: exchange.JWT, RefreshToken: exchange.RefreshToken})
 	if e != nil {
 		cliToServerErrorCounter.Inc()
 		log.Printf("unable to write jwt token: %v ", e)
@@ -222,38 +534,53 @@ func (app *app) exchangeHandler(writer http.ResponseWriter, request *http.Reques
 	serverResponseLatencies.WithLabelValues(request.Method).Observe(float64(elapsedSec))
 }
 
-func (rv *redisValues) setToken(jwt, token string) error {
-	if err := rv.client.Set(token, jwt, rv.timeToLive).Err(); err != nil {
+// stores the exchange under the token, refusing to overwrite a token that is already in use
+func (ts *tokenStore) setToken(exchange pendingExchange, token string, timeToLive time.Duration) error {
+	if err := ts.putValue(exchangeKeyPrefix+token, exchange, timeToLive); err != nil {
 		log.Printf("Error storing token in database: %v", err)
 		return err
 	}
 	return nil
 }
 
-// Generate SHA sum for JWT
-func (rv *redisValues) generateToken(jwt string) (string, error) {
-	hash := sha1.New()
-	_, e := hash.Write([]byte(jwt))
-	if e != nil {
-		log.Printf("error hashing jwt: %v ", e)
-		return "", e
+// creates an unguessable, URL safe value, used for exchange tokens, states and nonces
+func newRandomToken() (string, error) {
+	code := make([]byte, randomTokenSize)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(code), nil
+}
+
+// Generate a random one time token for the exchange and store it
+func (ts *tokenStore) generateToken(exchange pendingExchange, timeToLive time.Duration) (string, error) {
+	token, err := newRandomToken()
+	if err != nil {
+		log.Printf("error generating token: %v ", err)
+		return "", err
 	}
-	token := hash.Sum(nil)
 	tokenCounter.Inc()
-	if err := rv.setToken(jwt, fmt.Sprintf("%x", token)); err != nil {
+	if err := ts.setToken(exchange, token, timeToLive); err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%x", token), nil
+	return token, nil
 }
 
-// this will take the JWT and port and generate the URL that will be redirected to
-func (rv *redisValues) generateSendBackURL(jwt string, port string) (string, error) {
-	stringToken, err := rv.generateToken(jwt)
+// this will take the exchange, loopback host and port and callback secret and generate the URL that will be redirected to
+func (ts *tokenStore) generateSendBackURL(exchange pendingExchange, host string, port string, callbackSecret string) (string, error) {
+	stringToken, err := ts.generateToken(exchange, ts.timeToLive)
 	if err != nil {
 		log.Printf("Error when setting token in database")
 		return "", err
 	}
-	sendBackURL := "http://localhost:" + port + "/exchange/client?token=" + stringToken
+	query := url.Values{tokenField: {stringToken}}
+	if callbackSecret != "" {
+		query.Set(callbackSecretField, callbackSecret)
+	}
+	if host == "" {
+		host = cliLoopbackHost
+	}
+	sendBackURL := "http://" + net.JoinHostPort(host, port) + "/exchange/client?" + query.Encode()
 	return sendBackURL, nil
 }
 
@@ -265,12 +592,27 @@ func newAuthClient(clientID string, clientSecret string, redirectURI string, pro
 		redirectURI:  redirectURI,
 		client:       http.DefaultClient,
 		provider:     provider,
-		verifier:     provider.Verifier(&oidc.Config{ClientID: clientID}),
+		verifier:     newIDTokenVerifier(provider),
 		groupsClaim:  groupsClaim,
 		userClaim:    userClaim,
+		tokenType:    idTokenField,
 	}
 }
 
+// discovers the provider and sets up a client for it as configured
+func newProviderClient(ctx context.Context, config providerConfig) (*oidcClient, error) {
+	provider, err := oidc.NewProvider(ctx, config.OIDCProviderURL)
+	if err != nil {
+		return nil, err
+	}
+	authClient := newAuthClient(config.ClientID, config.ClientSecret, config.RedirectURL, provider, config.GroupsClaim, config.UserClaim)
+	authClient.offlineAccess = config.OfflineAccess
+	authClient.tokenType = config.TokenType
+	authClient.extraScopes = config.Scopes
+	log.Printf("Provider [%s] at %s uses [%s] as the JWT", config.Name, config.OIDCProviderURL, authClient.tokenType)
+	return authClient, nil
+}
+
 func healthHandler(writer http.ResponseWriter, request *http.Request) {
 	writer.WriteHeader(http.StatusOK)
 }
@@ -288,40 +630,55 @@ func getMux(app app, downloadDir string) *http.ServeMux {
 	newMux.HandleFunc("/callback", app.callbackHandler)
 	newMux.Handle("/download/", http.StripPrefix("/download", fs))
 	newMux.HandleFunc("/login", app.handleCLILogin)
+	newMux.HandleFunc("/login/", app.handleCLILogin)
 	newMux.HandleFunc("/health", healthHandler)
 	newMux.HandleFunc("/exchange", app.exchangeHandler)
+	newMux.HandleFunc("/refresh", app.refreshHandler)
+	newMux.HandleFunc("/logout", app.logoutHandler)
+	newMux.HandleFunc("/device", app.deviceVerificationHandler)
+	newMux.HandleFunc("/device/code", app.deviceAuthorizationHandler)
+	newMux.HandleFunc("/device/token", app.deviceTokenHandler)
+	newMux.HandleFunc("/catalog", app.catalogHandler)
+	newMux.HandleFunc("/authenticate", app.tokenReviewHandler)
 	newMux.Handle("/metrics", prometheus.Handler())
+	// named providers may have the provider send users back somewhere other than /callback
+	callbackPaths := map[string]bool{"/callback": true}
+	for _, authClient := range app.providers {
+		redirect, err := url.Parse(authClient.redirectURI)
+		if err != nil || redirect.Path == "" || callbackPaths[redirect.Path] {
+			continue
+		}
+		callbackPaths[redirect.Path] = true
+		newMux.HandleFunc(redirect.Path, app.callbackHandler)
+	}
 	return newMux
 }
 
-func setRedisValues(redisAddress string, redisPassword string, redisTTL time.Duration) *redisValues {
-	return &redisValues{
-		address:    redisAddress,
-		password:   redisPassword,
-		timeToLive: redisTTL,
+func newTokenStore(store Store, tokenTTL time.Duration, sessionTTL time.Duration) *tokenStore {
+	return &tokenStore{
+		store:             store,
+		timeToLive:        tokenTTL,
+		sessionTimeToLive: sessionTTL,
 	}
 }
 
-func setAppMemberFields(rv *redisValues, oidcClient *oidcClient) app {
-	return app{
-		redisValues: rv,
-		authClient:  oidcClient,
+// returns the client of the named provider, or of the default one for an empty name
+func (app *app) providerClient(name string) (*oidcClient, error) {
+	if name == "" {
+		return app.authClient, nil
+	}
+	authClient, ok := app.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%v %q", errUnknownProvider, name)
 	}
+	return authClient, nil
 }
 
-func (rv *redisValues) makeRedisClient() error {
-	rv.client = redis.NewClient(&redis.Options{
-		Addr:     rv.address,
-		Password: rv.password,
-		DB:       0,
-	})
-	ping, err := rv.client.Ping().Result()
-	if err != nil {
-		log.Printf("Error pinging Redis database: %v", err)
-		return err
+func setAppMemberFields(ts *tokenStore, oidcClient *oidcClient) app {
+	return app{
+		tokenStore: ts,
+		authClient: oidcClient,
 	}
-	log.Print(ping)
-	return nil
 }
 
 // registers the error and success counters with prometheus
@@ -332,76 +689,84 @@ func init() {
 	prometheus.MustRegister(serverToAuthRequestCounter)
 	prometheus.MustRegister(serverResponseLatencies)
 	prometheus.MustRegister(tokenCounter)
+	prometheus.MustRegister(exchangeReplayCounter)
+	prometheus.MustRegister(tokenVerificationErrorCounter)
+	prometheus.MustRegister(tokenReviewCounter)
 }
 
-// creates our Redis client for communication
-// creates an auth client based on the environment variables and provider
+// reads and checks the configuration, creates the store for tokens and login sessions and an auth
+// client for the provider, and serves
 func main() {
-	if os.Getenv("REDIS_ADDR") == "" {
-		log.Fatal("REDIS_ADDR not set! Is this variable configured in the deployment?")
-	}
-	if os.Getenv("REDIS_PASSWORD") == "" {
-		log.Fatal("REDIS_PASSWORD not set! This should be supplied as a secret in Kubernetes")
-	}
-	if os.Getenv("CLIENT_ID") == "" {
-		log.Fatal("CLIENT_ID not set!")
-	}
-	if os.Getenv("CLIENT_SECRET") == "" {
-		log.Fatal("CLIENT_SECRET not set!")
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML file to read the configuration from, environment variables override it")
+	printConfig := flag.Bool("print-config", false, "print the configuration with secrets redacted and exit")
+	validateConfig := flag.Bool("validate-config", false, "check the configuration and exit")
+	flag.Parse()
+	config, err := loadServerConfig(*configFile, os.LookupEnv)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if os.Getenv("REDIRECT_URL") == "" {
-		log.Fatal("REDIRECT_URL not set!")
+	configErr := config.validate()
+	if *printConfig {
+		out, err := yaml.Marshal(config.redacted())
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(out) // nolint: errcheck
 	}
-	if os.Getenv("HTTPS_CERT_PATH") == "" {
-		log.Fatal("HTTPS_CERT_PATH not set!")
+	if configErr != nil {
+		log.Fatal(configErr)
 	}
-	if os.Getenv("HTTPS_KEY_PATH") == "" {
-		log.Fatal("HTTPS_KEY_PATH not set!")
+	if *printConfig || *validateConfig {
+		log.Print("Configuration is valid")
+		os.Exit(0)
 	}
 
 	ctx := oidc.ClientContext(context.Background(), http.DefaultClient)
-	provider, err := oidc.NewProvider(ctx, os.Getenv("OIDC_PROVIDER_URL"))
+	providers := map[string]*oidcClient{}
+	for _, providerConfig := range config.providerConfigs() {
+		authClient, err := newProviderClient(ctx, providerConfig)
+		if err != nil {
+			log.Fatalf("error: %v\n", err.Error())
+		}
+		providers[providerConfig.Name] = authClient
+	}
+	store, err := newConfiguredStore(config.StoreType, config.RedisAddr, config.RedisPassword)
 	if err != nil {
-		log.Fatalf("error: %v\n", err.Error())
-	}
-	listenPortInt, err := strconv.Atoi(os.Getenv("LISTEN_PORT"))
-	if err != nil {
-		log.Fatalf("Error parsing port to listen on. Error: %v", err)
-	}
-	if listenPortInt < 0 || listenPortInt > 65536 {
-		log.Fatalf("LISTEN_PORT contains an invalid port. Port given: %v", listenPortInt)
-	}
-	listenPort := ":" + os.Getenv("LISTEN_PORT")
-	downloadDir := os.Getenv("DOWNLOAD_DIR")
-	if downloadDir == "" {
-		downloadDir = "/download"
-	}
-	groupsClaim := os.Getenv("GROUPS_CLAIM")
-	if groupsClaim == "" {
-		groupsClaim = "groups"
-	}
-	userClaim := os.Getenv("USER_CLAIM")
-	if userClaim == "" {
-		userClaim = "email"
-	}
-	ttl := os.Getenv("REDIS_TTL")
-	if ttl == "" {
-		ttl = "10s"
+		log.Fatalf("Error setting up the %s store: %v", config.StoreType, err)
 	}
-	redisTTL, err := time.ParseDuration(ttl)
+	encryptionKeys, err := loadEncryptionKeys(config.StoreEncryptionKeys, config.StoreEncryptionKeysFile)
 	if err != nil {
-		log.Fatal("Failed to parse the duration of the Redis TTL, please check that a valid value was set. e.g. 10s or 1m10s")
-	}
-	rv := setRedisValues(os.Getenv("REDIS_ADDR"), os.Getenv("REDIS_PASSWORD"), redisTTL)
-	oidcClient := newAuthClient(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"), os.Getenv("REDIRECT_URL"), provider, groupsClaim, userClaim)
-	app := setAppMemberFields(rv, oidcClient)
-	if err := app.redisValues.makeRedisClient(); err != nil {
-		log.Fatalf("Error communicating with Redis: %v", err)
-	}
-	mux := getMux(app, downloadDir)
-	crt := os.Getenv("HTTPS_CERT_PATH")
-	key := os.Getenv("HTTPS_KEY_PATH")
-	if err := http.ListenAndServeTLS(listenPort, crt, key, mux); err != nil {
+		log.Fatalf("Error loading store encryption keys: %v", err)
+	}
+	if len(encryptionKeys) > 0 {
+		log.Printf("Encrypting stored values with key [%s]", encryptionKeys[0].id)
+		store = newEncryptingStore(store, encryptionKeys)
+	} else {
+		log.Print("STORE_ENCRYPTION_KEYS not set! JWTs will be kept in the store as plaintext")
+	}
+	ts := newTokenStore(store, config.RedisTTL, config.LoginSessionTTL)
+	ts.deviceTimeToLive = config.DeviceCodeTTL
+	app := setAppMemberFields(ts, providers[""])
+	delete(providers, "")
+	app.providers = providers
+	app.devicePollInterval = config.DevicePollInterval
+	if config.CatalogFile != "" {
+		if app.catalog, err = loadCatalog(config.CatalogFile); err != nil {
+			log.Fatalf("Error loading the cluster catalog from %s: %v", config.CatalogFile, err)
+		}
+	}
+	if config.TokenReview {
+		log.Print("Serving the TokenReview webhook on /authenticate")
+		app.tokenReview = &tokenReviewSettings{
+			usernamePrefix: config.TokenReviewUsernamePrefix,
+			groupsPrefix:   config.TokenReviewGroupsPrefix,
+			bearerToken:    config.TokenReviewBearerToken,
+			audiences:      config.TokenReviewAudiences,
+		}
+	}
+	mux := getMux(app, config.DownloadDir)
+	listenPort := ":" + strconv.Itoa(config.ListenPort)
+	if err := http.ListenAndServeTLS(listenPort, config.HTTPSCertPath, config.HTTPSKeyPath, mux); err != nil {
 		log.Fatalf("Failed to listen on port: %s | Error: %v", listenPort, err)
 	}
 }
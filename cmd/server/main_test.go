@@ -1,28 +1,37 @@
 package main
 
 import (
-	"fmt"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/coreos/go-oidc"
+	"github.com/go-redis/redis"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// challenge for the verifier "hoopla"
+const testCodeChallenge = "xb66bdmk1WNflAYYyIWBi1q_D8g3NJuScfZTq7CwVzc"
+
 func TestServerSpecs(t *testing.T) {
 	Convey("Kubelogin Server", t, func() {
 		redisTTL, _ := time.ParseDuration("10s")
-		rv := setRedisValues(os.Getenv("REDIS_ADDR"), os.Getenv("REDIS_PASSWORD"), redisTTL)
+		ts := newTokenStore(newMemoryStore(), redisTTL, redisTTL)
 		oidcClient := newAuthClient(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"), os.Getenv("REDIRECT_URL"), &oidc.Provider{}, "groupsClaim", "userClaim")
-		app := setAppMemberFields(rv, oidcClient)
+		app := setAppMemberFields(ts, oidcClient)
 		unitTestServer := httptest.NewServer(getMux(app, "/downoad"))
 		Convey("The handleCLILogin function", func() {
 			Convey("should get a status code 303 for a correct redirect", func() {
-				url := unitTestServer.URL + "/login?port=8000"
+				url := unitTestServer.URL + "/login?port=8000&code_challenge=" + testCodeChallenge + "&code_challenge_method=S256"
 				app.authClient.client = &http.Client{
 					CheckRedirect: func(req *http.Request, via []*http.Request) error {
 						return http.ErrUseLastResponse
@@ -34,12 +43,63 @@ func TestServerSpecs(t *testing.T) {
 				resp.Body.Close() // nolint: errcheck
 				So(resp.StatusCode, ShouldEqual, 303)
 			})
+			Convey("should get a status code 303 for a manual login without a port", func() {
+				url := unitTestServer.URL + "/login?manual=true&code_challenge=" + testCodeChallenge + "&code_challenge_method=S256"
+				client := &http.Client{
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						return http.ErrUseLastResponse
+					},
+				}
+				resp, _ := client.Get(url)
+				resp.Body.Close() // nolint: errcheck
+				So(resp.StatusCode, ShouldEqual, 303)
+			})
+			Convey("should return a 400 error if the callback secret is too long", func() {
+				url := unitTestServer.URL + "/login?port=8000&code_challenge=" + testCodeChallenge + "&code_challenge_method=S256&callback_secret=" + strings.Repeat("a", maxCallbackSecretLength+1)
+				resp, _ := http.Get(url)
+				resp.Body.Close() // nolint: errcheck
+				So(resp.StatusCode, ShouldEqual, 400)
+			})
+			Convey("should still require a code challenge for a manual login", func() {
+				url := unitTestServer.URL + "/login?manual=true"
+				resp, _ := http.Get(url)
+				resp.Body.Close() // nolint: errcheck
+				So(resp.StatusCode, ShouldEqual, 400)
+			})
+			Convey("should return a 400 error if the host is not a loopback address", func() {
+				url := unitTestServer.URL + "/login?port=8000&host=attacker.example.com&code_challenge=" + testCodeChallenge + "&code_challenge_method=S256"
+				resp, _ := http.Get(url)
+				resp.Body.Close() // nolint: errcheck
+				So(resp.StatusCode, ShouldEqual, 400)
+				url = unitTestServer.URL + "/login?port=8000&host=10.0.0.1&code_challenge=" + testCodeChallenge + "&code_challenge_method=S256"
+				resp, _ = http.Get(url)
+				resp.Body.Close() // nolint: errcheck
+				So(resp.StatusCode, ShouldEqual, 400)
+			})
 			Convey("should return a 400 error if the port is missing", func() {
 				url := unitTestServer.URL + "/login?port="
 				resp, _ := http.Get(url)
 				resp.Body.Close() // nolint: errcheck
 				So(resp.StatusCode, ShouldEqual, 400)
 			})
+			Convey("should return a 400 error if the code challenge is missing", func() {
+				url := unitTestServer.URL + "/login?port=8000"
+				resp, _ := http.Get(url)
+				resp.Body.Close() // nolint: errcheck
+				So(resp.StatusCode, ShouldEqual, 400)
+			})
+			Convey("should return a 400 error if the port is not a port number", func() {
+				url := unitTestServer.URL + "/login?port=localhost&code_challenge=" + testCodeChallenge + "&code_challenge_method=S256"
+				resp, _ := http.Get(url)
+				resp.Body.Close() // nolint: errcheck
+				So(resp.StatusCode, ShouldEqual, 400)
+			})
+			Convey("should return a 400 error if the code challenge method is plain", func() {
+				url := unitTestServer.URL + "/login?port=8000&code_challenge=" + testCodeChallenge + "&code_challenge_method=plain"
+				resp, _ := http.Get(url)
+				resp.Body.Close() // nolint: errcheck
+				So(resp.StatusCode, ShouldEqual, 400)
+			})
 		})
 		Convey("callbackHandler", func() {
 			Convey("should return a bad request if no code or state is in the url", func() {
@@ -49,12 +109,19 @@ func TestServerSpecs(t *testing.T) {
 				response.Body.Close() // nolint: errcheck
 				So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
 			})
-			Convey("should return a internal server error if the authcode is not valid", func() {
-				fakeCodeURL := unitTestServer.URL + "/callback?code=asdf123&state=3000"
+			Convey("should return a bad request if the identity provider refused the login", func() {
+				url := unitTestServer.URL + "/callback?error=access_denied&state=hoopla"
+				request, _ := http.NewRequest("GET", url, nil)
+				response, _ := app.authClient.client.Do(request)
+				response.Body.Close() // nolint: errcheck
+				So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+			})
+			Convey("should return a bad request if the state is unknown", func() {
+				fakeCodeURL := unitTestServer.URL + "/callback?code=asdf123&state=hoopla"
 				request, _ := http.NewRequest("GET", fakeCodeURL, nil)
 				response, _ := app.authClient.client.Do(request)
 				response.Body.Close() // nolint: errcheck
-				So(response.StatusCode, ShouldEqual, http.StatusInternalServerError)
+				So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
 			})
 		})
 		Convey("defaultHandler", func() {
@@ -70,12 +137,7 @@ func TestServerSpecs(t *testing.T) {
 			})
 		})
 		Convey("exchangeHandler", func() {
-			Convey("should return a internal server error due to Redis not being available", func() {
-				err := app.redisValues.makeRedisClient()
-				if err != nil {
-					fmt.Printf("failed to create redis client: %v ", err)
-					return
-				}
+			Convey("should return unauthorized for a token that was never issued", func() {
 				exchangeURL := unitTestServer.URL + "/exchange?token=hoopla"
 				response, _ := http.Get(exchangeURL)
 				response.Body.Close() // nolint: errcheck
@@ -102,18 +164,22 @@ func TestGetField(t *testing.T) {
 			result := getField(newReq, "helloworld")
 			So(result, ShouldEqual, "")
 		})
+		Convey("does not log the value", func() {
+			var logged strings.Builder
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+			getField(newReq, authCodeField)
+			So(logged.String(), ShouldContainSubstring, authCodeField)
+			So(logged.String(), ShouldNotContainSubstring, "myawesomecode")
+		})
 
 	})
 }
 
-func TestMakeRedisClient(t *testing.T) {
-	Convey("makeRedisClient", t, func() {
-		redisTTL, _ := time.ParseDuration("10s")
-		rv := setRedisValues(os.Getenv("REDIS_ADDR"), os.Getenv("REDIS_PASSWORD"), redisTTL)
-		oidcClient := newAuthClient(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"), os.Getenv("REDIRECT_URL"), &oidc.Provider{}, "groupsClaim", "userClaim")
-		app := setAppMemberFields(rv, oidcClient)
+func TestNewRedisStore(t *testing.T) {
+	Convey("newRedisStore", t, func() {
 		Convey("should fail since no Redis address environment variable was set", func() {
-			err := app.redisValues.makeRedisClient()
+			_, err := newRedisStore(os.Getenv("REDIS_ADDR"), os.Getenv("REDIS_PASSWORD"))
 			So(err, ShouldNotEqual, nil)
 		})
 	})
@@ -122,35 +188,34 @@ func TestMakeRedisClient(t *testing.T) {
 func TestGenerateToken(t *testing.T) {
 	Convey("generateToken", t, func() {
 		redisTTL, _ := time.ParseDuration("10s")
-		rv := setRedisValues(os.Getenv("REDIS_ADDR"), os.Getenv("REDIS_PASSWORD"), redisTTL)
+		ts := newTokenStore(newMemoryStore(), redisTTL, redisTTL)
 		oidcClient := newAuthClient(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"), os.Getenv("REDIRECT_URL"), &oidc.Provider{}, "groupsClaim", "userClaim")
-		app := setAppMemberFields(rv, oidcClient)
-		err := app.redisValues.makeRedisClient()
-		if err != nil {
-			fmt.Printf("failed to create redis client: %v ", err)
-			return
-		}
+		app := setAppMemberFields(ts, oidcClient)
 		Convey("should pass since we are just returning a string", func() {
-			token, _ := app.redisValues.generateToken("hoopla")
+			token, _ := app.tokenStore.generateToken(pendingExchange{JWT: "hoopla", CodeChallenge: testCodeChallenge}, redisTTL)
 			So(token, ShouldNotEqual, nil)
 		})
 	})
 }
 
-func TestFetchJWTForToken(t *testing.T) {
-	Convey("fetchJWTForToken", t, func() {
+func TestFetchExchangeForToken(t *testing.T) {
+	Convey("fetchExchangeForToken", t, func() {
 		redisTTL, _ := time.ParseDuration("10s")
-		rv := setRedisValues(os.Getenv("REDIS_ADDR"), os.Getenv("REDIS_PASSWORD"), redisTTL)
+		ts := newTokenStore(newMemoryStore(), redisTTL, redisTTL)
 		oidcClient := newAuthClient(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"), os.Getenv("REDIRECT_URL"), &oidc.Provider{}, "groupsClaim", "userClaim")
-		app := setAppMemberFields(rv, oidcClient)
-		err := app.redisValues.makeRedisClient()
-		if err != nil {
-			fmt.Printf("failed to create redis client: %v ", err)
-			return
-		}
-		Convey("should error out since we can't access the Redis cache offline", func() {
-			_, err := app.redisValues.fetchJWTForToken("hoopla")
-			So(err, ShouldNotEqual, nil)
+		app := setAppMemberFields(ts, oidcClient)
+		Convey("should error out for a token that was never issued", func() {
+			_, err := app.tokenStore.fetchExchangeForToken("hoopla")
+			So(err, ShouldEqual, errTokenNotFound)
+		})
+		Convey("should hand back the exchange only once", func() {
+			token, err := app.tokenStore.generateToken(pendingExchange{JWT: "hoopla", CodeChallenge: testCodeChallenge}, redisTTL)
+			So(err, ShouldEqual, nil)
+			exchange, err := app.tokenStore.fetchExchangeForToken(token)
+			So(err, ShouldEqual, nil)
+			So(exchange.JWT, ShouldEqual, "hoopla")
+			_, err = app.tokenStore.fetchExchangeForToken(token)
+			So(err, ShouldEqual, errTokenNotFound)
 		})
 	})
 }
@@ -158,16 +223,28 @@ func TestFetchJWTForToken(t *testing.T) {
 func TestGenerateSendBackURL(t *testing.T) {
 	Convey("generateSendBackURL", t, func() {
 		redisTTL, _ := time.ParseDuration("10s")
-		rv := setRedisValues(os.Getenv("REDIS_ADDR"), os.Getenv("REDIS_PASSWORD"), redisTTL)
+		ts := newTokenStore(newMemoryStore(), redisTTL, redisTTL)
 		oidcClient := newAuthClient(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"), os.Getenv("REDIRECT_URL"), &oidc.Provider{}, "groupsClaim", "userClaim")
-		app := setAppMemberFields(rv, oidcClient)
-		err := app.redisValues.makeRedisClient()
-		if err != nil {
-			fmt.Printf("failed to create redis client: %v ", err)
-			return
-		}
+		app := setAppMemberFields(ts, oidcClient)
+		Convey("should send the CLI a token it can exchange", func() {
+			sendBackURL, err := app.tokenStore.generateSendBackURL(pendingExchange{JWT: "hoopla", CodeChallenge: testCodeChallenge}, "", "3000", "")
+			So(err, ShouldEqual, nil)
+			So(sendBackURL, ShouldStartWith, "http://127.0.0.1:3000/exchange/client?token=")
+		})
+		Convey("should send the CLI back to the loopback address it listens on", func() {
+			sendBackURL, err := app.tokenStore.generateSendBackURL(pendingExchange{JWT: "hoopla", CodeChallenge: testCodeChallenge}, "::1", "3000", "")
+			So(err, ShouldEqual, nil)
+			So(sendBackURL, ShouldStartWith, "http://[::1]:3000/exchange/client?token=")
+		})
+		Convey("should hand the callback secret back to the CLI", func() {
+			sendBackURL, err := app.tokenStore.generateSendBackURL(pendingExchange{JWT: "hoopla", CodeChallenge: testCodeChallenge}, "", "3000", "secret")
+			So(err, ShouldEqual, nil)
+			parsed, _ := url.Parse(sendBackURL)
+			So(parsed.Query().Get(callbackSecretField), ShouldEqual, "secret")
+		})
 		Convey("should pass since we will encounter errors when trying to add our value to Redis", func() {
-			_, err := app.redisValues.generateSendBackURL("hoopla", "3000")
+			app.tokenStore.store = &redisStore{client: redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})}
+			_, err := app.tokenStore.generateSendBackURL(pendingExchange{JWT: "hoopla", CodeChallenge: testCodeChallenge}, "", "3000", "")
 			log.Printf("The err is %s", err)
 			So(err, ShouldNotEqual, nil)
 		})
@@ -194,9 +271,9 @@ func TestNewAuthClient(t *testing.T) {
 func TestHealthHandler(t *testing.T) {
 	Convey("healthHandler", t, func() {
 		redisTTL, _ := time.ParseDuration("10s")
-		rv := setRedisValues(os.Getenv("REDIS_ADDR"), os.Getenv("REDIS_PASSWORD"), redisTTL)
+		ts := newTokenStore(newMemoryStore(), redisTTL, redisTTL)
 		oidcClient := newAuthClient(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"), os.Getenv("REDIRECT_URL"), &oidc.Provider{}, "groupsClaim", "userClaim")
-		app := setAppMemberFields(rv, oidcClient)
+		app := setAppMemberFields(ts, oidcClient)
 		unitTestServer := httptest.NewServer(getMux(app, "/download"))
 		Convey("Should write back to the response writer a statusOK", func() {
 			resp, _ := http.Get(unitTestServer.URL + "/health")
@@ -205,3 +282,175 @@ func TestHealthHandler(t *testing.T) {
 		})
 	})
 }
+
+func TestNewExchangeCode(t *testing.T) {
+	Convey("newRandomToken", t, func() {
+		Convey("should return a URL safe code with 256 bits of randomness", func() {
+			code, err := newRandomToken()
+			So(err, ShouldEqual, nil)
+			decoded, err := base64.RawURLEncoding.DecodeString(code)
+			So(err, ShouldEqual, nil)
+			So(len(decoded), ShouldEqual, randomTokenSize)
+		})
+		Convey("should not hand out the same code twice", func() {
+			first, _ := newRandomToken()
+			second, _ := newRandomToken()
+			So(first, ShouldNotEqual, second)
+		})
+	})
+}
+
+func TestValidateCodeChallenge(t *testing.T) {
+	Convey("validateCodeChallenge", t, func() {
+		Convey("should accept an S256 challenge", func() {
+			So(validateCodeChallenge(testCodeChallenge, codeChallengeMethodS256), ShouldEqual, nil)
+		})
+		Convey("should reject the plain method", func() {
+			So(validateCodeChallenge(testCodeChallenge, "plain"), ShouldNotEqual, nil)
+		})
+		Convey("should reject a challenge that is not a base64url SHA-256 sum", func() {
+			So(validateCodeChallenge("hoopla", codeChallengeMethodS256), ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestPendingExchangeVerify(t *testing.T) {
+	Convey("pendingExchange.verify", t, func() {
+		exchange := pendingExchange{JWT: "jwt", CodeChallenge: testCodeChallenge}
+		Convey("should accept the verifier the challenge was made from", func() {
+			So(exchange.verify("hoopla"), ShouldEqual, nil)
+		})
+		Convey("should reject any other verifier", func() {
+			So(exchange.verify("hooplah"), ShouldEqual, errBadVerifier)
+		})
+		Convey("should reject a missing verifier", func() {
+			So(exchange.verify(""), ShouldEqual, errBadVerifier)
+		})
+	})
+}
+
+func TestTakeLoginSession(t *testing.T) {
+	Convey("takeLoginSession", t, func() {
+		redisTTL, _ := time.ParseDuration("10s")
+		ts := newTokenStore(newMemoryStore(), redisTTL, redisTTL)
+		Convey("should only hand out a session once", func() {
+			state, session, err := ts.startLoginSession(loginSession{Port: "3000", CodeChallenge: testCodeChallenge})
+			So(err, ShouldEqual, nil)
+			So(state, ShouldNotEqual, session.Nonce)
+			taken, err := ts.takeLoginSession(state)
+			So(err, ShouldEqual, nil)
+			So(taken.Port, ShouldEqual, "3000")
+			_, err = ts.takeLoginSession(state)
+			So(err, ShouldEqual, errUnknownState)
+		})
+	})
+}
+
+func TestLoginFlow(t *testing.T) {
+	Convey("login flow", t, func() {
+		tp := newTestProvider()
+		defer tp.server.Close()
+		redisTTL, _ := time.ParseDuration("10s")
+		ts := newTokenStore(newMemoryStore(), redisTTL, redisTTL)
+		app := setAppMemberFields(ts, newAuthClient("client", "secret", "https://kubelogin.example.com/callback", tp.provider, "groups", "email"))
+		partnerProvider := newTestProvider()
+		defer partnerProvider.server.Close()
+		partners := newAuthClient("partner-client", "secret", "https://kubelogin.example.com/partners/callback", partnerProvider.provider, "groups", "email")
+		partners.extraScopes = []string{"profile"}
+		app.providers = map[string]*oidcClient{"partners": partners}
+		unitTestServer := httptest.NewServer(getMux(app, "/download"))
+		defer unitTestServer.Close()
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		// starts a login and plays the part of the user logging in at the provider
+		callback := func(login url.Values) *http.Response {
+			login.Set(codeChallengeField, testCodeChallenge)
+			login.Set(codeChallengeMethodField, codeChallengeMethodS256)
+			response, err := client.Get(unitTestServer.URL + "/login?" + login.Encode())
+			So(err, ShouldEqual, nil)
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusSeeOther)
+			authURL, err := url.Parse(response.Header.Get("Location"))
+			So(err, ShouldEqual, nil)
+			tp.tokenClaims = tp.claims("client")
+			tp.tokenClaims["nonce"] = authURL.Query().Get("nonce")
+			response, err = client.Get(unitTestServer.URL + "/callback?" + url.Values{authCodeField: {"code"}, stateField: {authURL.Query().Get(stateField)}}.Encode())
+			So(err, ShouldEqual, nil)
+			return response
+		}
+		exchange := func(token string) *http.Response {
+			request, _ := http.NewRequest("GET", unitTestServer.URL+"/exchange?"+url.Values{tokenField: {token}, codeVerifierField: {"hoopla"}}.Encode(), nil)
+			request.Header.Set("Accept", "application/json")
+			response, err := client.Do(request)
+			So(err, ShouldEqual, nil)
+			return response
+		}
+		Convey("should send the CLI a token it can exchange for the JWT once", func() {
+			response := callback(url.Values{portField: {"3000"}, callbackSecretField: {"secret"}})
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusSeeOther)
+			sendBackURL, err := url.Parse(response.Header.Get("Location"))
+			So(err, ShouldEqual, nil)
+			So(sendBackURL.Host, ShouldEqual, "127.0.0.1:3000")
+			So(sendBackURL.Query().Get(callbackSecretField), ShouldEqual, "secret")
+			response = exchange(sendBackURL.Query().Get(tokenField))
+			defer response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			var body tokenResponse
+			So(json.NewDecoder(response.Body).Decode(&body), ShouldEqual, nil)
+			So(body.Token, ShouldNotEqual, "")
+			replay := exchange(sendBackURL.Query().Get(tokenField))
+			replay.Body.Close() // nolint: errcheck
+			So(replay.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("should show the exchange token for a manual login", func() {
+			response := callback(url.Values{manualField: {"true"}})
+			defer response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			page, _ := ioutil.ReadAll(response.Body)
+			match := regexp.MustCompile(`<pre>([^<]+)</pre>`).FindSubmatch(page)
+			So(match, ShouldNotBeNil)
+			exchanged := exchange(string(match[1]))
+			exchanged.Body.Close() // nolint: errcheck
+			So(exchanged.StatusCode, ShouldEqual, http.StatusOK)
+		})
+		Convey("should log in with the provider named in the path and come back on its callback", func() {
+			login := url.Values{portField: {"3000"}, codeChallengeField: {testCodeChallenge}, codeChallengeMethodField: {codeChallengeMethodS256}}
+			response, err := client.Get(unitTestServer.URL + "/login/partners?" + login.Encode())
+			So(err, ShouldEqual, nil)
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusSeeOther)
+			authURL, err := url.Parse(response.Header.Get("Location"))
+			So(err, ShouldEqual, nil)
+			So(authURL.Host, ShouldEqual, strings.TrimPrefix(partnerProvider.server.URL, "http://"))
+			So(authURL.Query().Get("client_id"), ShouldEqual, "partner-client")
+			So(authURL.Query().Get("scope"), ShouldContainSubstring, "profile")
+			partnerProvider.tokenClaims = partnerProvider.claims("partner-client")
+			partnerProvider.tokenClaims["nonce"] = authURL.Query().Get("nonce")
+			response, err = client.Get(unitTestServer.URL + "/partners/callback?" + url.Values{authCodeField: {"code"}, stateField: {authURL.Query().Get(stateField)}}.Encode())
+			So(err, ShouldEqual, nil)
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusSeeOther)
+			sendBackURL, err := url.Parse(response.Header.Get("Location"))
+			So(err, ShouldEqual, nil)
+			So(sendBackURL.Host, ShouldEqual, "127.0.0.1:3000")
+		})
+		Convey("should take the provider as a parameter too", func() {
+			login := url.Values{manualField: {"true"}, providerField: {"partners"}, codeChallengeField: {testCodeChallenge}, codeChallengeMethodField: {codeChallengeMethodS256}}
+			response, err := client.Get(unitTestServer.URL + "/login?" + login.Encode())
+			So(err, ShouldEqual, nil)
+			response.Body.Close() // nolint: errcheck
+			So(response.Header.Get("Location"), ShouldStartWith, partnerProvider.server.URL)
+		})
+		Convey("should refuse a provider it doesn't know", func() {
+			login := url.Values{manualField: {"true"}, codeChallengeField: {testCodeChallenge}, codeChallengeMethodField: {codeChallengeMethodS256}}
+			response, err := client.Get(unitTestServer.URL + "/login/hoopla?" + login.Encode())
+			So(err, ShouldEqual, nil)
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+const refreshTokenField = "refresh_token"
+
+// CLIs that understand refresh tokens ask for JSON; older ones get the bare JWT they always have
+func writeToken(writer http.ResponseWriter, request *http.Request, response tokenResponse) error {
+	if !strings.Contains(request.Header.Get("Accept"), "application/json") {
+		_, err := writer.Write([]byte(response.Token))
+		return err
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(writer).Encode(response)
+}
+
+// mints a new JWT from a refresh token the CLI got through /exchange. The refresh token is only accepted
+// in a POST body so that it stays out of access logs.
+func (app *app) refreshHandler(writer http.ResponseWriter, request *http.Request) {
+	startTime := time.Now()
+	cliToServerRequestCounter.Inc()
+	if request.Method != http.MethodPost {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	refreshToken := request.PostFormValue(refreshTokenField)
+	if refreshToken == "" {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, "No refresh token in request", http.StatusBadRequest)
+		return
+	}
+	// the refresh token has to go back to the provider that issued it
+	authClient, err := app.providerClient(request.PostFormValue(providerField))
+	if err != nil {
+		cliToServerErrorCounter.Inc()
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	serverToAuthRequestCounter.Inc()
+	oidcClientContext := oidc.ClientContext(request.Context(), authClient.client)
+	token, err := authClient.getOAuth2Config(nil).TokenSource(oidcClientContext, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		serverToAuthErrorCounter.Inc()
+		log.Printf("Failed to refresh token. Error: %v", err)
+		http.Error(writer, "Refresh token was not accepted", http.StatusUnauthorized)
+		return
+	}
+	// refreshed ID tokens carry no nonce, there was no login to bind them to
+	jwt, err := authClient.jwtFromToken(oidcClientContext, token, "")
+	if err != nil {
+		serverToAuthErrorCounter.Inc()
+		http.Error(writer, "Refreshed token could not be verified", http.StatusUnauthorized)
+		return
+	}
+
+	if err := writeToken(writer, request, tokenResponse{Token: jwt, RefreshToken: token.RefreshToken}); err != nil {
+		cliToServerErrorCounter.Inc()
+		log.Printf("unable to write jwt token: %v ", err)
+		return
+	}
+
+	elapsedTime := time.Since(startTime)
+	elapsedSec := elapsedTime / time.Second
+	serverResponseLatencies.WithLabelValues(request.Method).Observe(float64(elapsedSec))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRefreshHandler(t *testing.T) {
+	Convey("refreshHandler", t, func() {
+		tp := newTestProvider()
+		defer tp.server.Close()
+		authClient := newAuthClient("client", "secret", "redirect", tp.provider, "groups", "email")
+		app := setAppMemberFields(nil, authClient)
+		partnerProvider := newTestProvider()
+		defer partnerProvider.server.Close()
+		app.providers = map[string]*oidcClient{"partners": newAuthClient("partner-client", "secret", "redirect", partnerProvider.provider, "groups", "email")}
+		unitTestServer := httptest.NewServer(getMux(app, "/download"))
+		defer unitTestServer.Close()
+		refresh := func(method string, form url.Values) *http.Response {
+			request, _ := http.NewRequest(method, unitTestServer.URL+"/refresh", strings.NewReader(form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			request.Header.Set("Accept", "application/json")
+			response, _ := http.DefaultClient.Do(request)
+			return response
+		}
+		Convey("should return a new verified token and the rotated refresh token", func() {
+			tp.tokenClaims = tp.claims("client")
+			tp.refreshToken = "rotated"
+			response := refresh("POST", url.Values{refreshTokenField: {"hoopla"}})
+			defer response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			var body tokenResponse
+			So(json.NewDecoder(response.Body).Decode(&body), ShouldEqual, nil)
+			So(body.Token, ShouldNotEqual, "")
+			So(body.RefreshToken, ShouldEqual, "rotated")
+		})
+		Convey("should keep handing back the same refresh token if the provider does not rotate it", func() {
+			tp.tokenClaims = tp.claims("client")
+			response := refresh("POST", url.Values{refreshTokenField: {"hoopla"}})
+			defer response.Body.Close() // nolint: errcheck
+			var body tokenResponse
+			So(json.NewDecoder(response.Body).Decode(&body), ShouldEqual, nil)
+			So(body.RefreshToken, ShouldEqual, "hoopla")
+		})
+		Convey("should return unauthorized if the provider refuses the refresh token", func() {
+			response := refresh("POST", url.Values{refreshTokenField: {"hoopla"}})
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("should return unauthorized if the refreshed token fails verification", func() {
+			tp.tokenClaims = tp.claims("other")
+			response := refresh("POST", url.Values{refreshTokenField: {"hoopla"}})
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("should refresh at the provider the CLI names", func() {
+			partnerProvider.tokenClaims = partnerProvider.claims("partner-client")
+			response := refresh("POST", url.Values{refreshTokenField: {"hoopla"}, providerField: {"partners"}})
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+		})
+		Convey("should return a bad request for a provider it doesn't know", func() {
+			response := refresh("POST", url.Values{refreshTokenField: {"hoopla"}, providerField: {"hoopla"}})
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("should return a bad request without a refresh token", func() {
+			response := refresh("POST", url.Values{})
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("should not accept a refresh token in the URL", func() {
+			response := refresh("GET", url.Values{})
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+	})
+}
+
+func TestWriteToken(t *testing.T) {
+	Convey("writeToken", t, func() {
+		response := tokenResponse{Token: "jwt", RefreshToken: "refresh"}
+		Convey("should write the bare JWT for clients that don't ask for JSON", func() {
+			request, _ := http.NewRequest("GET", "/exchange", nil)
+			recorder := httptest.NewRecorder()
+			So(writeToken(recorder, request, response), ShouldEqual, nil)
+			So(recorder.Body.String(), ShouldEqual, "jwt")
+		})
+		Convey("should write JSON with the refresh token for clients that ask for it", func() {
+			request, _ := http.NewRequest("GET", "/exchange", nil)
+			request.Header.Set("Accept", "application/json")
+			recorder := httptest.NewRecorder()
+			So(writeToken(recorder, request, response), ShouldEqual, nil)
+			var body tokenResponse
+			So(json.Unmarshal(recorder.Body.Bytes(), &body), ShouldEqual, nil)
+			So(body, ShouldResemble, response)
+		})
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	redisStoreType  = "redis"
+	memoryStoreType = "memory"
+)
+
+var errKeyExists = errors.New("key already exists in store")
+
+// Store keeps the short lived values the server hands out between requests. Values are opaque to the store.
+type Store interface {
+	// Put stores the value for the given time and returns errKeyExists rather than overwriting a key in use
+	Put(key string, value []byte, timeToLive time.Duration) error
+	// Take returns the value and removes it in one step so that it can only be read once, or errNotFound
+	Take(key string) ([]byte, error)
+	// Get returns the value and leaves it in place, or errNotFound
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	Ping() error
+}
+
+// picks the store named by STORE_TYPE. The in-memory store is only shared within one process, so it is
+// only suitable when running a single replica.
+func newConfiguredStore(storeType, redisAddr, redisPassword string) (Store, error) {
+	switch storeType {
+	case redisStoreType:
+		return newRedisStore(redisAddr, redisPassword)
+	case memoryStoreType:
+		log.Print("Using the in-memory store, logins will fail if more than one replica is running")
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown STORE_TYPE %q, expected %s or %s", storeType, redisStoreType, memoryStoreType)
+}
+
+type redisStore struct {
+	client *redis.Client
+}
+
+func newRedisStore(address, password string) (*redisStore, error) {
+	store := &redisStore{client: redis.NewClient(&redis.Options{
+		Addr:     address,
+		Password: password,
+		DB:       0,
+	})}
+	if err := store.Ping(); err != nil {
+		log.Printf("Error pinging Redis database: %v", err)
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *redisStore) Put(key string, value []byte, timeToLive time.Duration) error {
+	stored, err := store.client.SetNX(key, value, timeToLive).Result()
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return errKeyExists
+	}
+	return nil
+}
+
+// GET and DEL run in one transaction so two requests can't both read the value
+func (store *redisStore) Take(key string) ([]byte, error) {
+	var value *redis.StringCmd
+	_, err := store.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		value = pipe.Get(key)
+		pipe.Del(key)
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value.Bytes()
+}
+
+func (store *redisStore) Get(key string) ([]byte, error) {
+	value, err := store.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, errNotFound
+	}
+	return value, err
+}
+
+func (store *redisStore) Delete(key string) error {
+	return store.client.Del(key).Err()
+}
+
+func (store *redisStore) Ping() error {
+	ping, err := store.client.Ping().Result()
+	if err != nil {
+		return err
+	}
+	log.Print(ping)
+	return nil
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryStore is a Store for a single replica. Expired entries are never handed out and are swept on each Put.
+type memoryStore struct {
+	mutex   sync.Mutex
+	entries map[string]memoryEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: map[string]memoryEntry{}}
+}
+
+func (store *memoryStore) Put(key string, value []byte, timeToLive time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	for k, entry := range store.entries {
+		if !now.Before(entry.expires) {
+			delete(store.entries, k)
+		}
+	}
+	if _, ok := store.entries[key]; ok {
+		return errKeyExists
+	}
+	store.entries[key] = memoryEntry{value: append([]byte(nil), value...), expires: now.Add(timeToLive)}
+	return nil
+}
+
+func (store *memoryStore) Take(key string) ([]byte, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry, ok := store.entries[key]
+	if !ok {
+		return nil, errNotFound
+	}
+	delete(store.entries, key)
+	if !time.Now().Before(entry.expires) {
+		return nil, errNotFound
+	}
+	return entry.value, nil
+}
+
+func (store *memoryStore) Get(key string) ([]byte, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry, ok := store.entries[key]
+	if !ok || !time.Now().Before(entry.expires) {
+		return nil, errNotFound
+	}
+	return entry.value, nil
+}
+
+func (store *memoryStore) Delete(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.entries, key)
+	return nil
+}
+
+func (store *memoryStore) Ping() error {
+	return nil
+}
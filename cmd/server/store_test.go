@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMemoryStore(t *testing.T) {
+	Convey("memoryStore", t, func() {
+		store := newMemoryStore()
+		Convey("should hand out a value only once", func() {
+			So(store.Put("key", []byte("hoopla"), time.Minute), ShouldEqual, nil)
+			value, err := store.Take("key")
+			So(err, ShouldEqual, nil)
+			So(string(value), ShouldEqual, "hoopla")
+			_, err = store.Take("key")
+			So(err, ShouldEqual, errNotFound)
+		})
+		Convey("should not overwrite a key in use", func() {
+			So(store.Put("key", []byte("hoopla"), time.Minute), ShouldEqual, nil)
+			So(store.Put("key", []byte("other"), time.Minute), ShouldEqual, errKeyExists)
+			value, _ := store.Take("key")
+			So(string(value), ShouldEqual, "hoopla")
+		})
+		Convey("should not hand out an expired value", func() {
+			So(store.Put("key", []byte("hoopla"), time.Millisecond), ShouldEqual, nil)
+			time.Sleep(5 * time.Millisecond)
+			_, err := store.Take("key")
+			So(err, ShouldEqual, errNotFound)
+		})
+		Convey("should let an expired key be reused and sweep it away", func() {
+			So(store.Put("key", []byte("hoopla"), time.Millisecond), ShouldEqual, nil)
+			time.Sleep(5 * time.Millisecond)
+			So(store.Put("other", []byte("hoopla"), time.Minute), ShouldEqual, nil)
+			So(len(store.entries), ShouldEqual, 1)
+			So(store.Put("key", []byte("again"), time.Minute), ShouldEqual, nil)
+		})
+		Convey("should read a value without removing it", func() {
+			So(store.Put("key", []byte("hoopla"), time.Minute), ShouldEqual, nil)
+			value, err := store.Get("key")
+			So(err, ShouldEqual, nil)
+			So(string(value), ShouldEqual, "hoopla")
+			value, _ = store.Take("key")
+			So(string(value), ShouldEqual, "hoopla")
+			_, err = store.Get("key")
+			So(err, ShouldEqual, errNotFound)
+		})
+		Convey("should delete a value", func() {
+			So(store.Put("key", []byte("hoopla"), time.Minute), ShouldEqual, nil)
+			So(store.Delete("key"), ShouldEqual, nil)
+			_, err := store.Take("key")
+			So(err, ShouldEqual, errNotFound)
+		})
+	})
+}
+
+func TestNewConfiguredStore(t *testing.T) {
+	Convey("newConfiguredStore", t, func() {
+		Convey("should create an in-memory store", func() {
+			store, err := newConfiguredStore(memoryStoreType, "", "")
+			So(err, ShouldEqual, nil)
+			So(store.Ping(), ShouldEqual, nil)
+		})
+		Convey("should refuse an unknown store type", func() {
+			_, err := newConfiguredStore("hoopla", "", "")
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the authentication.k8s.io versions the API server may send; both have the same shape
+const (
+	tokenReviewKind              = "TokenReview"
+	tokenReviewAPIVersion        = "authentication.k8s.io/v1"
+	tokenReviewAPIVersionV1beta1 = "authentication.k8s.io/v1beta1"
+)
+
+// all the API server hears about a denied token; why it was denied is only logged
+const tokenReviewDenied = "the token was not accepted"
+
+var tokenReviewCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kubelogin_tokenReviews_total",
+	Help: "number of TokenReviews answered for API servers. classified by whether the token was authenticated",
+},
+	[]string{"result"})
+
+// tokenReviewSettings is how users are named to the API servers, the bearer token they authenticate with and
+// the audiences tokens are good for, if the API servers' own ones aren't to be trusted; nil on the app turns
+// the webhook off
+type tokenReviewSettings struct {
+	usernamePrefix string
+	groupsPrefix   string
+	bearerToken    string
+	audiences      []string
+}
+
+// tokenReview is the part of the Kubernetes TokenReview object the webhook reads and writes
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool                 `json:"authenticated"`
+	User          *tokenReviewUserInfo `json:"user,omitempty"`
+	Audiences     []string             `json:"audiences,omitempty"`
+	Error         string               `json:"error,omitempty"`
+}
+
+type tokenReviewUserInfo struct {
+	Username string   `json:"username"`
+	UID      string   `json:"uid,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// unverifiedClaims are read before verification only to find the provider that has to verify the token
+type unverifiedClaims struct {
+	Issuer   string      `json:"iss"`
+	Audience interface{} `json:"aud"`
+}
+
+// the issuer from the provider's discovery document, empty if it can't be read
+func (authClient *oidcClient) issuer() string {
+	var discovery struct {
+		Issuer string `json:"issuer"`
+	}
+	if authClient.provider == nil {
+		return ""
+	}
+	if err := authClient.provider.Claims(&discovery); err != nil {
+		return ""
+	}
+	return discovery.Issuer
+}
+
+// Finds the provider whose issuer and client the token claims to be from. Nothing read here is trusted;
+// the provider found still verifies the token.
+func (app *app) tokenProvider(rawJWT string) (*oidcClient, error) {
+	parts := strings.Split(rawJWT, ".")
+	if len(parts) != 3 {
+		return nil, verificationFailure(reasonMalformed, "token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, verificationFailure(reasonMalformed, "%v", err)
+	}
+	var claims unverifiedClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, verificationFailure(reasonMalformed, "%v", err)
+	}
+	audience := stringsFromClaim(claims.Audience)
+	authClients := []*oidcClient{app.authClient}
+	for _, authClient := range app.providers {
+		authClients = append(authClients, authClient)
+	}
+	for _, authClient := range authClients {
+		if authClient.issuer() == claims.Issuer && containsString(audience, authClient.clientID) {
+			return authClient, nil
+		}
+	}
+	return nil, verificationFailure(reasonIssuer, "no provider of this server has issuer %q and one of the audiences %q", claims.Issuer, audience)
+}
+
+// Verifies the token the way login does, without a nonce since the API server never saw the login, and
+// without counting failures as login ones. The API server sends the audiences it accepts, by default its
+// service account issuer, and with no audiences in the answer it takes the token to be good for all of them.
+// Only configured audiences are checked against them, and what the two have in common is returned.
+func (app *app) reviewToken(ctx context.Context, rawJWT string, audiences []string) (*tokenReviewUserInfo, []string, error) {
+	authClient, err := app.tokenProvider(rawJWT)
+	if err != nil {
+		return nil, nil, err
+	}
+	who, err := authClient.checkIDToken(ctx, rawJWT, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	var accepted []string
+	if len(app.tokenReview.audiences) > 0 && len(audiences) > 0 {
+		for _, audience := range audiences {
+			if containsString(app.tokenReview.audiences, audience) {
+				accepted = append(accepted, audience)
+			}
+		}
+		if len(accepted) == 0 {
+			return nil, nil, verificationFailure(reasonAudience, "the API server accepts the audiences %q, tokens are only good for %q", audiences, app.tokenReview.audiences)
+		}
+	}
+	user := &tokenReviewUserInfo{Username: app.tokenReview.usernamePrefix + who.user, UID: who.subject}
+	for _, group := range who.groups {
+		user.Groups = append(user.Groups, app.tokenReview.groupsPrefix+group)
+	}
+	return user, accepted, nil
+}
+
+// answers the API server's webhook token authentication. A token that fails verification is still a
+// 200 with authenticated set to false, which is how the API server expects to be told. Only callers with
+// the configured bearer token get an answer.
+func (app *app) tokenReviewHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if app.tokenReview == nil {
+		http.Error(writer, "This server does not authenticate tokens for Kubernetes", http.StatusNotFound)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(request.Header.Get("Authorization")), []byte("Bearer "+app.tokenReview.bearerToken)) != 1 {
+		log.Printf("TokenReview from %s refused: missing or wrong bearer token", request.RemoteAddr)
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var review tokenReview
+	if err := json.NewDecoder(request.Body).Decode(&review); err != nil {
+		http.Error(writer, "Request is not a TokenReview", http.StatusBadRequest)
+		return
+	}
+	if review.Kind != tokenReviewKind || (review.APIVersion != tokenReviewAPIVersion && review.APIVersion != tokenReviewAPIVersionV1beta1) {
+		http.Error(writer, "Expected a TokenReview of "+tokenReviewAPIVersion+" or "+tokenReviewAPIVersionV1beta1, http.StatusBadRequest)
+		return
+	}
+
+	response := tokenReview{APIVersion: review.APIVersion, Kind: review.Kind}
+	user, audiences, err := app.reviewToken(request.Context(), review.Spec.Token, review.Spec.Audiences)
+	if err != nil {
+		tokenReviewCounter.WithLabelValues("denied").Inc()
+		log.Printf("TokenReview denied: %v", err)
+		response.Status.Error = tokenReviewDenied
+	} else {
+		tokenReviewCounter.WithLabelValues("authenticated").Inc()
+		log.Printf("TokenReview authenticated user [%s] with groups %v", user.Username, user.Groups)
+		response.Status.Authenticated = true
+		response.Status.User = user
+		response.Status.Audiences = audiences
+	}
+	writeJSON(writer, http.StatusOK, response)
+}
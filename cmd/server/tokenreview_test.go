@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenReviewHandler(t *testing.T) {
+	Convey("tokenReviewHandler", t, func() {
+		tp := newTestProvider()
+		defer tp.server.Close()
+		partnerProvider := newTestProvider()
+		defer partnerProvider.server.Close()
+		app := setAppMemberFields(nil, newAuthClient("client", "secret", "redirect", tp.provider, "groups", "email"))
+		app.providers = map[string]*oidcClient{"partners": newAuthClient("partner-client", "secret", "redirect", partnerProvider.provider, "groups", "email")}
+		app.tokenReview = &tokenReviewSettings{usernamePrefix: "oidc:", groupsPrefix: "oidc:", bearerToken: "apiserver-secret"}
+		unitTestServer := httptest.NewServer(getMux(app, "/download"))
+		defer unitTestServer.Close()
+		post := func(authorization, body string) *http.Response {
+			request, err := http.NewRequest(http.MethodPost, unitTestServer.URL+"/authenticate", bytes.NewBufferString(body))
+			So(err, ShouldEqual, nil)
+			request.Header.Set("Content-Type", "application/json")
+			if authorization != "" {
+				request.Header.Set("Authorization", authorization)
+			}
+			response, err := http.DefaultClient.Do(request)
+			So(err, ShouldEqual, nil)
+			return response
+		}
+		review := func(body string) (*http.Response, tokenReview) {
+			response := post("Bearer apiserver-secret", body)
+			defer response.Body.Close() // nolint: errcheck
+			var answer tokenReview
+			if response.StatusCode == http.StatusOK {
+				So(json.NewDecoder(response.Body).Decode(&answer), ShouldEqual, nil)
+			}
+			return response, answer
+		}
+		reviewOf := func(apiVersion, token string, audiences ...string) string {
+			body, _ := json.Marshal(tokenReview{APIVersion: apiVersion, Kind: tokenReviewKind, Spec: tokenReviewSpec{Token: token, Audiences: audiences}})
+			return string(body)
+		}
+		Convey("should authenticate a valid token with the prefixed user and groups", func() {
+			response, answer := review(reviewOf(tokenReviewAPIVersion, tp.sign(tp.claims("client"))))
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			So(answer.APIVersion, ShouldEqual, tokenReviewAPIVersion)
+			So(answer.Kind, ShouldEqual, tokenReviewKind)
+			So(answer.Status.Authenticated, ShouldBeTrue)
+			So(answer.Status.User, ShouldResemble, &tokenReviewUserInfo{Username: "oidc:user@example.com", UID: "subject", Groups: []string{"oidc:admins", "oidc:devs"}})
+		})
+		Convey("should verify a token of a named provider with that provider", func() {
+			_, answer := review(reviewOf(tokenReviewAPIVersionV1beta1, partnerProvider.sign(partnerProvider.claims("partner-client"))))
+			So(answer.APIVersion, ShouldEqual, tokenReviewAPIVersionV1beta1)
+			So(answer.Status.Authenticated, ShouldBeTrue)
+		})
+		Convey("should deny a token signed by someone else claiming to be a provider", func() {
+			claims := partnerProvider.claims("client")
+			claims["iss"] = tp.server.URL
+			_, answer := review(reviewOf(tokenReviewAPIVersion, partnerProvider.sign(claims)))
+			So(answer.Status.Authenticated, ShouldBeFalse)
+			So(answer.Status.User, ShouldBeNil)
+			So(answer.Status.Error, ShouldEqual, tokenReviewDenied)
+		})
+		Convey("should deny an expired token", func() {
+			claims := tp.claims("client")
+			claims["exp"] = claims["iat"]
+			_, answer := review(reviewOf(tokenReviewAPIVersion, tp.sign(claims)))
+			So(answer.Status.Authenticated, ShouldBeFalse)
+		})
+		Convey("should deny a token for another client or from an unknown issuer", func() {
+			_, answer := review(reviewOf(tokenReviewAPIVersion, tp.sign(tp.claims("other"))))
+			So(answer.Status.Authenticated, ShouldBeFalse)
+			claims := tp.claims("client")
+			claims["iss"] = "https://elsewhere.example.com"
+			_, answer = review(reviewOf(tokenReviewAPIVersion, tp.sign(claims)))
+			So(answer.Status.Authenticated, ShouldBeFalse)
+			_, answer = review(reviewOf(tokenReviewAPIVersion, "hoopla"))
+			So(answer.Status.Authenticated, ShouldBeFalse)
+		})
+		Convey("should leave the audiences to the API server unless they are configured", func() {
+			_, answer := review(reviewOf(tokenReviewAPIVersion, tp.sign(tp.claims("client")), "https://kubernetes.default.svc"))
+			So(answer.Status.Authenticated, ShouldBeTrue)
+			So(answer.Status.Audiences, ShouldBeEmpty)
+		})
+		Convey("should only authenticate for the configured audiences the API server accepts", func() {
+			app.tokenReview.audiences = []string{"kubelogin", "https://kubernetes.default.svc"}
+			_, answer := review(reviewOf(tokenReviewAPIVersion, tp.sign(tp.claims("client")), "https://kubernetes.default.svc", "other"))
+			So(answer.Status.Authenticated, ShouldBeTrue)
+			So(answer.Status.Audiences, ShouldResemble, []string{"https://kubernetes.default.svc"})
+			_, answer = review(reviewOf(tokenReviewAPIVersion, tp.sign(tp.claims("client")), "other"))
+			So(answer.Status.Authenticated, ShouldBeFalse)
+			So(answer.Status.Error, ShouldEqual, tokenReviewDenied)
+		})
+		Convey("should not count denied tokens as failed logins", func() {
+			counter := tokenVerificationErrorCounter
+			defer func() { tokenVerificationErrorCounter = counter }()
+			tokenVerificationErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_verification_errors", Help: "test"}, []string{"reason"})
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(tokenVerificationErrorCounter)
+			expired := tp.claims("client")
+			expired["exp"] = expired["iat"]
+			_, answer := review(reviewOf(tokenReviewAPIVersion, tp.sign(expired)))
+			So(answer.Status.Authenticated, ShouldBeFalse)
+			_, answer = review(reviewOf(tokenReviewAPIVersion, "hoopla"))
+			So(answer.Status.Authenticated, ShouldBeFalse)
+			families, err := registry.Gather()
+			So(err, ShouldEqual, nil)
+			So(families, ShouldBeEmpty)
+		})
+		Convey("should refuse callers without the bearer token", func() {
+			body := reviewOf(tokenReviewAPIVersion, tp.sign(tp.claims("client")))
+			for _, authorization := range []string{"", "Bearer wrong", "apiserver-secret"} {
+				response := post(authorization, body)
+				response.Body.Close() // nolint: errcheck
+				So(response.StatusCode, ShouldEqual, http.StatusUnauthorized)
+			}
+		})
+		Convey("should refuse what isn't a TokenReview", func() {
+			response, _ := review(`{"apiVersion":"v1","kind":"Pod"}`)
+			So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+			response, _ = review("hoopla")
+			So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("should not be served unless turned on", func() {
+			app.tokenReview = nil
+			unitTestServer := httptest.NewServer(getMux(app, "/download"))
+			defer unitTestServer.Close()
+			response, err := http.Post(unitTestServer.URL+"/authenticate", "application/json", bytes.NewBufferString(reviewOf(tokenReviewAPIVersion, tp.sign(tp.claims("client")))))
+			So(err, ShouldEqual, nil)
+			response.Body.Close() // nolint: errcheck
+			So(response.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reasons an ID token can be refused, used as the label on tokenVerificationErrorCounter
+const (
+	reasonMissingToken = "missing_token"
+	reasonMalformed    = "malformed"
+	reasonSignature    = "signature"
+	reasonIssuer       = "issuer"
+	reasonAudience     = "audience"
+	reasonExpired      = "expired"
+	reasonNonce        = "nonce"
+	reasonMissingClaim = "missing_claim"
+	// the provider's keys couldn't be fetched, so the token was never checked
+	reasonKeySet  = "key_set"
+	reasonUnknown = "unknown"
+)
+
+var tokenVerificationErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kubelogin_tokenVerificationErrors_total",
+	Help: "number of ID tokens from the auth server that failed verification. classified by the reason",
+},
+	[]string{"reason"})
+
+// tokenVerificationError keeps the reason separate from the message so it can be used as a metric label
+type tokenVerificationError struct {
+	reason string
+	err    error
+}
+
+func (e *tokenVerificationError) Error() string {
+	return fmt.Sprintf("id token failed %s check: %v", e.reason, e.err)
+}
+
+func verificationFailure(reason string, format string, args ...interface{}) *tokenVerificationError {
+	return &tokenVerificationError{reason: reason, err: fmt.Errorf(format, args...)}
+}
+
+// identity is what we learned about the user from a verified ID token
+type identity struct {
+	subject string
+	user    string
+	groups  []string
+	expiry  time.Time
+}
+
+// the verifier built here checks signature and issuer; audience and expiry are checked by verifyIDToken
+// itself so that each failure can be told apart
+func newIDTokenVerifier(provider *oidc.Provider) *oidc.IDTokenVerifier {
+	return provider.Verifier(&oidc.Config{SkipClientIDCheck: true, SkipExpiryCheck: true})
+}
+
+// go-oidc only hands back formatted errors, so the message is the only thing to classify on
+func classifyVerifyError(err error) string {
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "different provider"):
+		return reasonIssuer
+	case strings.Contains(message, "malformed"), strings.Contains(message, "mallformed"), strings.Contains(message, "unmarshal"):
+		return reasonMalformed
+	// key set errors are wrapped in the signature error, so they have to be told apart first
+	case strings.Contains(message, "fetching keys"), strings.Contains(message, "get keys failed"), strings.Contains(message, "failed to decode keys"):
+		return reasonKeySet
+	case strings.Contains(message, "signature"), strings.Contains(message, "not signed"), strings.Contains(message, "unsupported algorithm"):
+		return reasonSignature
+	}
+	return reasonUnknown
+}
+
+// checkIDToken for the ID tokens of logins, counting failures in tokenVerificationErrorCounter
+func (authClient *oidcClient) verifyIDToken(ctx context.Context, rawIDToken string, nonce string) (*identity, error) {
+	who, err := authClient.checkIDToken(ctx, rawIDToken, nonce)
+	if failure, ok := err.(*tokenVerificationError); ok {
+		tokenVerificationErrorCounter.WithLabelValues(failure.reason).Inc()
+	}
+	return who, err
+}
+
+// verifies signature, issuer, audience, expiry and nonce of the raw ID token and pulls out the configured claims.
+// An empty nonce skips the nonce check, which is only appropriate for tokens that were not minted by a login.
+func (authClient *oidcClient) checkIDToken(ctx context.Context, rawIDToken string, nonce string) (*identity, error) {
+	if rawIDToken == "" {
+		return nil, verificationFailure(reasonMissingToken, "field [%s] not found in token", idTokenField)
+	}
+	idToken, err := authClient.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, verificationFailure(classifyVerifyError(err), "%v", err)
+	}
+	if !containsString(idToken.Audience, authClient.clientID) {
+		return nil, verificationFailure(reasonAudience, "expected audience %q got %q", authClient.clientID, idToken.Audience)
+	}
+	if !idToken.Expiry.After(time.Now()) {
+		return nil, verificationFailure(reasonExpired, "token expired at %v", idToken.Expiry)
+	}
+	if nonce != "" && subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, verificationFailure(reasonNonce, "%v", errNonceMismatch)
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, verificationFailure(reasonMalformed, "%v", err)
+	}
+	user, ok := claims[authClient.userClaim].(string)
+	if !ok || user == "" {
+		return nil, verificationFailure(reasonMissingClaim, "claim [%s] not found in token", authClient.userClaim)
+	}
+	return &identity{
+		subject: idToken.Subject,
+		user:    user,
+		groups:  stringsFromClaim(claims[authClient.groupsClaim]),
+		expiry:  idToken.Expiry,
+	}, nil
+}
+
+// providers send groups as either a list or, when there is only one, a plain string
+func stringsFromClaim(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func logIdentity(who *identity) {
+	log.Printf("Authenticated subject [%s] as user [%s] with groups %v", who.subject, who.user, who.groups)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	. "github.com/smartystreets/goconvey/convey"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// testProvider is a minimal OIDC provider serving discovery, keys and a token endpoint, and signing
+// whatever claims it is given
+type testProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	provider *oidc.Provider
+	// claims of the ID token the token endpoint hands out; nil makes the token endpoint refuse the grant
+	tokenClaims map[string]interface{}
+	// the refresh token the token endpoint hands out
+	refreshToken string
+	// the tokens the revocation endpoint was asked to revoke, and the client that asked
+	revokedTokens  []string
+	revokingClient string
+}
+
+func newTestProvider() *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	tp := &testProvider{key: key}
+	mux := http.NewServeMux()
+	tp.server = httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(map[string]string{ // nolint: errcheck
+			"issuer":                 tp.server.URL,
+			"authorization_endpoint": tp.server.URL + "/auth",
+			"token_endpoint":         tp.server.URL + "/token",
+			"jwks_uri":               tp.server.URL + "/keys",
+			"revocation_endpoint":    tp.server.URL + "/revoke",
+			"end_session_endpoint":   tp.server.URL + "/logout?ui=1",
+		})
+	})
+	mux.HandleFunc("/revoke", func(writer http.ResponseWriter, request *http.Request) {
+		tp.revokingClient, _, _ = request.BasicAuth()
+		tp.revokedTokens = append(tp.revokedTokens, request.PostFormValue("token"))
+	})
+	mux.HandleFunc("/keys", func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{ // nolint: errcheck
+			{Key: key.Public(), KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(writer http.ResponseWriter, request *http.Request) {
+		if tp.tokenClaims == nil {
+			writer.Header().Set("Content-Type", "application/json")
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte(`{"error":"invalid_grant"}`)) // nolint: errcheck
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]interface{}{ // nolint: errcheck
+			"access_token":  "access",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"refresh_token": tp.refreshToken,
+			"id_token":      tp.sign(tp.tokenClaims),
+		})
+	})
+	tp.provider, err = oidc.NewProvider(context.Background(), tp.server.URL)
+	if err != nil {
+		panic(err)
+	}
+	return tp
+}
+
+// standard claims for a token minted for the given client, valid for an hour
+func (tp *testProvider) claims(clientID string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    tp.server.URL,
+		"sub":    "subject",
+		"aud":    clientID,
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"iat":    time.Now().Unix(),
+		"email":  "user@example.com",
+		"groups": []string{"admins", "devs"},
+	}
+}
+
+func (tp *testProvider) sign(claims map[string]interface{}) string {
+	return signClaims(tp.key, claims)
+}
+
+func signClaims(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		panic(err)
+	}
+	payload, _ := json.Marshal(claims)
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		panic(err)
+	}
+	raw, _ := signed.CompactSerialize()
+	return raw
+}
+
+func verificationReason(err error) string {
+	if failure, ok := err.(*tokenVerificationError); ok {
+		return failure.reason
+	}
+	return ""
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	Convey("verifyIDToken", t, func() {
+		tp := newTestProvider()
+		defer tp.server.Close()
+		authClient := newAuthClient("client", "secret", "redirect", tp.provider, "groups", "email")
+		ctx := context.Background()
+		Convey("should return the user and groups of a valid token", func() {
+			claims := tp.claims("client")
+			claims["nonce"] = "nonce"
+			who, err := authClient.verifyIDToken(ctx, tp.sign(claims), "nonce")
+			So(err, ShouldEqual, nil)
+			So(who.subject, ShouldEqual, "subject")
+			So(who.user, ShouldEqual, "user@example.com")
+			So(who.groups, ShouldResemble, []string{"admins", "devs"})
+		})
+		Convey("should refuse a missing token", func() {
+			_, err := authClient.verifyIDToken(ctx, "", "")
+			So(verificationReason(err), ShouldEqual, reasonMissingToken)
+		})
+		Convey("should refuse a token that is not a JWT", func() {
+			_, err := authClient.verifyIDToken(ctx, "hoopla", "")
+			So(verificationReason(err), ShouldEqual, reasonMalformed)
+		})
+		Convey("should refuse a token signed by another key", func() {
+			otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+			_, err := authClient.verifyIDToken(ctx, signClaims(otherKey, tp.claims("client")), "")
+			So(verificationReason(err), ShouldEqual, reasonSignature)
+		})
+		Convey("should not blame the token when the provider's keys can't be fetched", func() {
+			unreachable := newTestProvider()
+			unreachable.server.Close()
+			offline := newAuthClient("client", "secret", "redirect", unreachable.provider, "groups", "email")
+			_, err := offline.verifyIDToken(ctx, unreachable.sign(unreachable.claims("client")), "")
+			So(verificationReason(err), ShouldEqual, reasonKeySet)
+		})
+		Convey("should refuse a token from another issuer", func() {
+			claims := tp.claims("client")
+			claims["iss"] = "https://other.example.com"
+			_, err := authClient.verifyIDToken(ctx, tp.sign(claims), "")
+			So(verificationReason(err), ShouldEqual, reasonIssuer)
+		})
+		Convey("should refuse a token for another audience", func() {
+			_, err := authClient.verifyIDToken(ctx, tp.sign(tp.claims("other")), "")
+			So(verificationReason(err), ShouldEqual, reasonAudience)
+		})
+		Convey("should refuse an expired token", func() {
+			claims := tp.claims("client")
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			_, err := authClient.verifyIDToken(ctx, tp.sign(claims), "")
+			So(verificationReason(err), ShouldEqual, reasonExpired)
+		})
+		Convey("should refuse a token with the wrong nonce", func() {
+			claims := tp.claims("client")
+			claims["nonce"] = "other"
+			_, err := authClient.verifyIDToken(ctx, tp.sign(claims), "nonce")
+			So(verificationReason(err), ShouldEqual, reasonNonce)
+		})
+		Convey("should refuse a token without the user claim", func() {
+			claims := tp.claims("client")
+			delete(claims, "email")
+			_, err := authClient.verifyIDToken(ctx, tp.sign(claims), "")
+			So(verificationReason(err), ShouldEqual, reasonMissingClaim)
+		})
+	})
+}
+
+func TestStringsFromClaim(t *testing.T) {
+	Convey("stringsFromClaim", t, func() {
+		Convey("should accept a single string", func() {
+			So(stringsFromClaim("admins"), ShouldResemble, []string{"admins"})
+		})
+		Convey("should return nil for a missing claim", func() {
+			So(stringsFromClaim(nil), ShouldBeNil)
+		})
+	})
+}
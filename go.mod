@@ -24,6 +24,7 @@ require (
 	golang.org/x/oauth2 v0.0.0-20170629190718-cce311a261e6
 	google.golang.org/appengine v1.6.7 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
-	gopkg.in/square/go-jose.v2 v2.1.2 // indirect
+	gopkg.in/square/go-jose.v2 v2.1.2
 	gopkg.in/yaml.v2 v2.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )